@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/webp"
+)
+
+// AnimatedImage is a decoded animation, with every frame composited and cropped to a square.
+type AnimatedImage struct {
+	Frames    []*image.NRGBA
+	Durations []time.Duration
+}
+
+// Resize returns a copy of the animation with every frame downscaled to the given size.
+func (a *AnimatedImage) Resize(size int) *AnimatedImage {
+	resized := &AnimatedImage{Frames: make([]*image.NRGBA, len(a.Frames)), Durations: a.Durations}
+	for i, frame := range a.Frames {
+		resized.Frames[i] = imaging.Resize(frame, size, size, imaging.Lanczos)
+	}
+	return resized
+}
+
+var ErrAnimationTooLong = errors.New("animation has too many frames or is too long")
+
+// Browsers play frames with very short durations at 100ms, since many animations rely on this.
+func normaliseFrameDuration(duration time.Duration) time.Duration {
+	if duration <= 10*time.Millisecond {
+		return 100 * time.Millisecond
+	}
+	return duration
+}
+
+// checkAnimationLimits enforces the configured frame count and duration limits on an animation,
+// and ensures decoding it won't use too much memory.
+func checkAnimationLimits(frames int, duration time.Duration, width int, height int) error {
+	if frames > config.Limits.MaxAvatarFrames ||
+		duration > time.Duration(config.Limits.MaxAvatarDuration)*time.Second {
+		return ErrAnimationTooLong
+	} else if width <= 0 || height <= 0 || width*height > maxImagePixels ||
+		width*height*frames > 4*maxImagePixels {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// DecodeAnimation decodes an animated GIF or WebP, cropping and downscaling its frames to fit in a
+// square of the given size. If the image is not animated, nil is returned.
+func DecodeAnimation(data []byte, size int) (*AnimatedImage, error) {
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		return decodeAnimatedGIF(data, size)
+	} else if len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return decodeAnimatedWebP(data, size)
+	}
+	return nil, nil
+}
+
+// cropAnimationFrame copies the current state of an animation's canvas into a square frame.
+func cropAnimationFrame(canvas *image.NRGBA, size int) *image.NRGBA {
+	bounds := canvas.Bounds()
+	res := min(bounds.Dx(), bounds.Dy(), size)
+	return imaging.Fill(canvas, res, res, imaging.Center, imaging.Lanczos)
+}
+
+// scanGIF counts the frames in a GIF and adds up their durations without decoding them, by walking
+// through its blocks.
+func scanGIF(data []byte) (int, time.Duration, error) {
+	errInvalid := errors.New("gif: invalid format")
+	if len(data) < 13 {
+		return 0, 0, errInvalid
+	}
+	position := 13
+	if flags := data[10]; flags&0x80 != 0 { // Global color table
+		position += 3 << ((flags & 0x07) + 1)
+	}
+	skipSubBlocks := func() bool {
+		for position < len(data) {
+			length := int(data[position])
+			position += 1 + length
+			if length == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	frames, duration, delay := 0, time.Duration(0), time.Duration(0)
+	for position < len(data) {
+		switch data[position] {
+		case 0x21: // Extension
+			if position+1 >= len(data) {
+				return 0, 0, errInvalid
+			}
+			// Graphic control extensions hold the delay of the next frame in hundredths of a second
+			if data[position+1] == 0xF9 && position+6 < len(data) && data[position+2] == 4 {
+				delay = time.Duration(binary.LittleEndian.Uint16(data[position+4:])) * 10 * time.Millisecond
+			}
+			position += 2
+			if !skipSubBlocks() {
+				return 0, 0, errInvalid
+			}
+		case 0x2C: // Image descriptor
+			if position+10 >= len(data) {
+				return 0, 0, errInvalid
+			}
+			flags := data[position+9]
+			position += 10
+			if flags&0x80 != 0 { // Local color table
+				position += 3 << ((flags & 0x07) + 1)
+			}
+			position++ // LZW minimum code size
+			if !skipSubBlocks() {
+				return 0, 0, errInvalid
+			}
+			frames++
+			duration += normaliseFrameDuration(delay)
+			delay = 0
+		case 0x3B: // Trailer
+			return frames, duration, nil
+		default:
+			return 0, 0, errInvalid
+		}
+	}
+	return frames, duration, nil // Some encoders omit the trailer
+}
+
+func decodeAnimatedGIF(data []byte, size int) (*AnimatedImage, error) {
+	frames, duration, err := scanGIF(data)
+	if err != nil {
+		return nil, err
+	} else if frames <= 1 {
+		return nil, nil
+	}
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	} else if err = checkAnimationLimits(frames, duration, cfg.Width, cfg.Height); err != nil {
+		return nil, err
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	animation := &AnimatedImage{}
+	canvas := image.NewNRGBA(image.Rect(0, 0, decoded.Config.Width, decoded.Config.Height))
+	var previous *image.NRGBA
+	for i, frame := range decoded.Image {
+		if decoded.Disposal[i] == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		animation.Frames = append(animation.Frames, cropAnimationFrame(canvas, size))
+		animation.Durations = append(animation.Durations,
+			normaliseFrameDuration(time.Duration(decoded.Delay[i])*10*time.Millisecond))
+		switch decoded.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return animation, nil
+}
+
+type webpChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// readWebPChunks splits RIFF chunk data into its chunks.
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	chunks := make([]webpChunk, 0)
+	for len(data) >= 8 {
+		length := int(binary.LittleEndian.Uint32(data[4:8]))
+		if length < 0 || 8+length > len(data) {
+			return nil, errors.New("webp: invalid chunk length")
+		}
+		chunks = append(chunks, webpChunk{fourCC: string(data[0:4]), data: data[8 : 8+length]})
+		data = data[min(len(data), 8+length+length%2):] // Chunks are padded to an even length
+	}
+	return chunks, nil
+}
+
+func appendWebPChunk(data []byte, fourCC string, chunk []byte) []byte {
+	data = append(data, fourCC...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(chunk)))
+	data = append(data, chunk...)
+	if len(chunk)%2 == 1 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+func readUint24(data []byte) int {
+	return int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+}
+
+func decodeAnimatedWebP(data []byte, size int) (*AnimatedImage, error) {
+	chunks, err := readWebPChunks(data[12:])
+	if err != nil {
+		return nil, err
+	} else if len(chunks) == 0 || chunks[0].fourCC != "VP8X" || len(chunks[0].data) < 10 ||
+		chunks[0].data[0]&0x02 == 0 { // Animation flag
+		return nil, nil
+	}
+	width, height := readUint24(chunks[0].data[4:])+1, readUint24(chunks[0].data[7:])+1
+	frames, duration := 0, time.Duration(0)
+	for _, chunk := range chunks {
+		if chunk.fourCC == "ANMF" && len(chunk.data) >= 16 {
+			frames++
+			duration += normaliseFrameDuration(time.Duration(readUint24(chunk.data[12:])) * time.Millisecond)
+		}
+	}
+	if frames <= 1 {
+		return nil, nil
+	} else if err = checkAnimationLimits(frames, duration, width, height); err != nil {
+		return nil, err
+	}
+
+	animation := &AnimatedImage{}
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for _, chunk := range chunks {
+		if chunk.fourCC != "ANMF" || len(chunk.data) < 16 {
+			continue
+		}
+		header := chunk.data[:16]
+		x, y := readUint24(header[0:])*2, readUint24(header[3:])*2
+		frameWidth, frameHeight := readUint24(header[6:])+1, readUint24(header[9:])+1
+		blend, dispose := header[15]&0x02 == 0, header[15]&0x01 != 0
+
+		// Each frame is made up of chunks which can be decoded as a standalone WebP image
+		frameChunks, err := readWebPChunks(chunk.data[16:])
+		if err != nil {
+			return nil, err
+		}
+		body := []byte("WEBP")
+		for _, frameChunk := range frameChunks {
+			if frameChunk.fourCC == "ALPH" { // Alpha chunks require a VP8X chunk
+				vp8x := make([]byte, 10)
+				vp8x[0] = 0x10 // Alpha flag
+				vp8x[4], vp8x[5], vp8x[6] = byte(frameWidth-1), byte((frameWidth-1)>>8), byte((frameWidth-1)>>16)
+				vp8x[7], vp8x[8], vp8x[9] = byte(frameHeight-1), byte((frameHeight-1)>>8), byte((frameHeight-1)>>16)
+				body = appendWebPChunk(body, "VP8X", vp8x)
+				break
+			}
+		}
+		for _, frameChunk := range frameChunks {
+			if frameChunk.fourCC == "ALPH" || frameChunk.fourCC == "VP8 " || frameChunk.fourCC == "VP8L" {
+				body = appendWebPChunk(body, frameChunk.fourCC, frameChunk.data)
+			}
+		}
+		frame, err := webp.Decode(bytes.NewReader(appendWebPChunk(nil, "RIFF", body)))
+		if err != nil {
+			return nil, err
+		}
+
+		rect := image.Rect(x, y, x+frameWidth, y+frameHeight)
+		if blend {
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, draw.Over)
+		} else {
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, draw.Src)
+		}
+		animation.Frames = append(animation.Frames, cropAnimationFrame(canvas, size))
+		animation.Durations = append(animation.Durations,
+			normaliseFrameDuration(time.Duration(readUint24(header[12:]))*time.Millisecond))
+		if dispose {
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return animation, nil
+}
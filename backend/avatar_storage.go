@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Avatar images are stored in the database, unless a blob store is configured, in which case new
+// images are written to the blob store and stored in the database with empty data. Images already
+// in the database keep being served from it.
+
+// AvatarBlobStore stores avatar images outside the database, grouped by the hash of their avatar.
+type AvatarBlobStore interface {
+	Put(hash string, name string, data []byte) error
+	Get(hash string, name string) ([]byte, error)
+	// Delete deletes every image of an avatar.
+	Delete(hash string) error
+	// List returns the hash of every avatar with images in the store, and when they were last written.
+	List() (map[string]time.Time, error)
+	// Usage returns the number of images in the store and their total size in bytes.
+	Usage() (int, int64, error)
+}
+
+var avatarBlobStore AvatarBlobStore
+
+// InitAvatarBlobStore sets up the filesystem blob store if avatarStoragePath is configured.
+func InitAvatarBlobStore() error {
+	if config.AvatarStoragePath == "" {
+		return nil
+	} else if err := os.MkdirAll(config.AvatarStoragePath, 0700); err != nil {
+		return err
+	}
+	avatarBlobStore = fsBlobStore{root: config.AvatarStoragePath}
+	return nil
+}
+
+const avatarOriginalBlob = "original"
+
+func avatarVariantBlob(size int, format string, animated bool) string {
+	if animated {
+		return fmt.Sprintf("%d-animated.%s", size, format)
+	}
+	return fmt.Sprintf("%d.%s", size, format)
+}
+
+// storeAvatarBlob writes an avatar image to the blob store if configured, and returns the data to
+// store in the database in its place.
+func storeAvatarBlob(hash string, name string, data []byte) ([]byte, error) {
+	if avatarBlobStore == nil {
+		return data, nil
+	}
+	return []byte{}, avatarBlobStore.Put(hash, name, data)
+}
+
+// loadAvatarBlob returns an avatar image read from the database, reading it from the blob store if
+// it was stored there instead.
+func loadAvatarBlob(hash string, name string, data []byte) ([]byte, error) {
+	if len(data) > 0 {
+		return data, nil
+	} else if avatarBlobStore == nil {
+		return nil, errors.New("avatar " + hash + " is in the blob store, but avatarStoragePath is not configured")
+	}
+	return avatarBlobStore.Get(hash, name)
+}
+
+// fsBlobStore stores avatar images as files in a directory per avatar.
+type fsBlobStore struct {
+	root string
+}
+
+func (s fsBlobStore) dir(hash string) string {
+	return filepath.Join(s.root, hash[:2], hash)
+}
+
+func (s fsBlobStore) Put(hash string, name string, data []byte) error {
+	dir := s.dir(hash)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a partially written image is never read
+	file, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (s fsBlobStore) Get(hash string, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir(hash), name))
+}
+
+func (s fsBlobStore) Delete(hash string) error {
+	return os.RemoveAll(s.dir(hash))
+}
+
+func (s fsBlobStore) List() (map[string]time.Time, error) {
+	hashes := make(map[string]time.Time)
+	prefixes, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.root, prefix.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && entry.IsDir() && len(entry.Name()) == 64 {
+				hashes[entry.Name()] = info.ModTime()
+			}
+		}
+	}
+	return hashes, nil
+}
+
+func (s fsBlobStore) Usage() (int, int64, error) {
+	files, size := 0, int64(0)
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// CollectOrphanedAvatars deletes avatars which no user has used for the configured grace period,
+// along with their variants and any images in the blob store without an avatar. Avatars which fail
+// to be deleted are skipped, and the errors are returned together.
+func CollectOrphanedAvatars() error {
+	cutoff := time.Now().Add(-time.Duration(config.AvatarGracePeriod) * time.Minute)
+	rows, err := findOrphanedAvatarsStmt.Query(cutoff)
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			break
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	errs := []error{err, rows.Err()}
+
+	deleted := 0
+	for _, hash := range hashes {
+		// The avatar may have been used again since it was found
+		result, err := deleteOrphanedAvatarStmt.Exec(hash, cutoff)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+		if avatarBlobStore != nil {
+			errs = append(errs, avatarBlobStore.Delete(hash))
+		}
+	}
+	if deleted > 0 {
+		slog.Info("Deleted orphaned avatars.", "count", deleted)
+	}
+
+	// Images are written to the blob store before their avatar is inserted, which may fail
+	if avatarBlobStore == nil {
+		return errors.Join(errs...)
+	}
+	stored, err := avatarBlobStore.List()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for hash, modified := range stored {
+		if modified.After(cutoff) {
+			continue
+		}
+		var animated bool
+		if err := findAvatarAnimatedStmt.QueryRow(hash).Scan(&animated); errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, avatarBlobStore.Delete(hash))
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PrintAvatarStorageReport prints how much storage avatars and their variants are using, for the
+// `concinnity avatar-storage` command.
+func PrintAvatarStorageReport() error {
+	var count, orphaned int
+	var size int64
+	if err := findAvatarStorageStmt.QueryRow().Scan(&count, &size, &orphaned); err != nil {
+		return err
+	}
+	fmt.Printf("Avatars: %d (%s in database, %d no longer used)\n", count, formatBytes(size), orphaned)
+
+	rows, err := findAvatarVariantStorageStmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	fmt.Println("Avatar variants:")
+	for rows.Next() {
+		var variantSize int
+		var format string
+		var animated bool
+		if err = rows.Scan(&variantSize, &format, &animated, &count, &size); err != nil {
+			return err
+		}
+		kind := "static"
+		if animated {
+			kind = "animated"
+		}
+		fmt.Printf("  %dpx %s %s: %d (%s in database)\n", variantSize, kind, format, count, formatBytes(size))
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if avatarBlobStore != nil {
+		files, size, err := avatarBlobStore.Usage()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Blob store (%s): %d images (%s)\n", config.AvatarStoragePath, files, formatBytes(size))
+	}
+	return nil
+}
+
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.2f GB", float64(size)/(1024*1024*1024))
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.2f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.2f KB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// Avatars are content-addressed by the hash of their original image, so the variants derived from
+// an avatar never change, and can be cached indefinitely by both the server and clients.
+
+const (
+	AvatarFormatAVIF = "avif"
+	AvatarFormatWebP = "webp"
+	AvatarFormatPNG  = "png"
+	AvatarFormatJPEG = "jpeg"
+)
+
+// Formats avatars can be served in, in order of preference when negotiating with the client.
+var avatarFormats = []string{AvatarFormatAVIF, AvatarFormatWebP, AvatarFormatPNG, AvatarFormatJPEG}
+
+var avatarContentTypes = map[string]string{
+	AvatarFormatAVIF: "image/avif",
+	AvatarFormatWebP: "image/webp",
+	AvatarFormatPNG:  "image/png",
+	AvatarFormatJPEG: "image/jpeg",
+}
+
+// IsAvatarFormatSupported returns whether the configured image pipeline can serve avatars in a
+// format. WebP requires cwebp to be installed.
+func IsAvatarFormatSupported(format string) bool {
+	_, ok := imageCodecs[format]
+	return ok
+}
+
+// NegotiateAvatarFormat picks the format to serve an avatar in from an Accept header, preferring
+// the highest quality value, then types listed explicitly over wildcards, then avatarFormats order.
+// An empty string is returned if the client accepts none of the supported formats.
+func NegotiateAvatarFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+	bestFormat, bestQuality, bestExplicit := "", 0.0, false
+	for _, format := range avatarFormats {
+		if !IsAvatarFormatSupported(format) {
+			continue
+		}
+		contentType := avatarContentTypes[format]
+		quality, explicit, matched := 0.0, false, 0
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, _ := strings.Cut(mediaRange, ";")
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+			specificity := 0
+			if mediaType == contentType {
+				specificity = 3
+			} else if mediaType == "image/*" {
+				specificity = 2
+			} else if mediaType == "*/*" {
+				specificity = 1
+			}
+			if specificity <= matched { // The most specific matching media range applies
+				continue
+			}
+			matched, quality = specificity, 1
+			for _, param := range strings.Split(params, ";") {
+				if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(key) == "q" {
+					if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+						quality = q
+					}
+				}
+			}
+			explicit = specificity == 3
+		}
+		if quality > bestQuality || (quality == bestQuality && quality > 0 && explicit && !bestExplicit) {
+			bestFormat, bestQuality, bestExplicit = format, quality, explicit
+		}
+	}
+	return bestFormat
+}
+
+// AvatarCache is an in-memory LRU cache of avatar images, bounded by their total size in bytes.
+type AvatarCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+type avatarCacheEntry struct {
+	key  string
+	data []byte
+}
+
+func NewAvatarCache(maxSize int) *AvatarCache {
+	return &AvatarCache{maxSize: maxSize, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *AvatarCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*avatarCacheEntry).data, true
+	}
+	return nil, false
+}
+
+// Add caches an image, evicting the least recently used images to stay within the size limit.
+// Images larger than an eighth of the cache are not cached, so they cannot flush it.
+func (c *AvatarCache) Add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok || len(data) > c.maxSize/8 {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&avatarCacheEntry{key: key, data: data})
+	c.size += len(data)
+	for c.size > c.maxSize {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*avatarCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= len(entry.data)
+	}
+}
+
+var avatarCache *AvatarCache
+
+// InitAvatarCache creates the avatar cache with the size configured in the limits.
+func InitAvatarCache() {
+	avatarCache = NewAvatarCache(config.Limits.AvatarCacheSize * 1024 * 1024)
+}
+
+// avatarVariantCall is an in-progress lookup or generation of an avatar variant, which concurrent
+// requests for the same variant wait on instead of repeating the work.
+type avatarVariantCall struct {
+	done      chan struct{}
+	data      []byte
+	cacheable bool
+	err       error
+}
+
+var avatarVariantCalls *xsync.MapOf[string, *avatarVariantCall] = xsync.NewMapOf[string, *avatarVariantCall]()
+
+// GetAvatarVariant returns an avatar downscaled to the given size (or at its original size if 0)
+// in the given format. Animated avatars are returned animated if the format supports animations,
+// unless static is true, in which case their first frame is returned. Variants are generated once,
+// then stored in the database and cached in memory. If the avatar does not exist, sql.ErrNoRows is
+// returned.
+func GetAvatarVariant(hash string, size int, format string, static bool) ([]byte, bool, error) {
+	key := hash + "/" + strconv.Itoa(size) + "." + format
+	if static {
+		key += "/static"
+	}
+	return getCachedAvatar(key, func() ([]byte, bool, error) {
+		return findOrCreateAvatarVariant(hash, size, format, static)
+	})
+}
+
+// getCachedAvatar returns an avatar image from the cache, else creates it with the given function,
+// which returns whether the image can be cached. Images which cannot be cached are placeholders, and
+// clients should not cache them either.
+func getCachedAvatar(key string, create func() ([]byte, bool, error)) ([]byte, bool, error) {
+	if data, ok := avatarCache.Get(key); ok {
+		return data, true, nil
+	}
+
+	call := &avatarVariantCall{done: make(chan struct{})}
+	if existing, loaded := avatarVariantCalls.LoadOrStore(key, call); loaded {
+		<-existing.done
+		return existing.data, existing.cacheable, existing.err
+	}
+	call.data, call.cacheable, call.err = create()
+	if call.err == nil && call.cacheable {
+		avatarCache.Add(key, call.data)
+	}
+	avatarVariantCalls.Delete(key)
+	close(call.done)
+	return call.data, call.cacheable, call.err
+}
+
+// findOrCreateAvatarVariant returns whether the variant is complete, as animated variants can only
+// be generated while the avatar is uploaded, and the original is returned in their place until then.
+func findOrCreateAvatarVariant(hash string, size int, format string, static bool) ([]byte, bool, error) {
+	var animated bool
+	if err := findAvatarAnimatedStmt.QueryRow(hash).Scan(&animated); err != nil {
+		return nil, false, err
+	}
+	animated = animated && !static && SupportsAnimation(format)
+	var data []byte
+	name := avatarVariantBlob(size, format, animated)
+	err := findAvatarVariantStmt.QueryRow(hash, size, format, animated).Scan(&data)
+	if err == nil {
+		data, err = loadAvatarBlob(hash, name, data)
+		return data, err == nil, err
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+	var original Avatar
+	err = findAvatarByHashStmt.QueryRow(hash).Scan(
+		&original.Hash, &original.Data, &original.CreatedAt, &original.Animated)
+	if err != nil {
+		return nil, false, err
+	} else if original.Data, err = loadAvatarBlob(hash, avatarOriginalBlob, original.Data); err != nil {
+		return nil, false, err
+	} else if animated {
+		if size > 0 {
+			slog.Warn("Animated avatar variant is not generated yet!", "hash", hash, "size", size)
+		}
+		return original.Data, size == 0, nil
+	}
+
+	// Every avatar has a 1:1 aspect ratio, so only avatars larger than the size need resizing
+	ctx := context.Background()
+	originalImage, originalFormat, err := DecodeImage(ctx, original.Data)
+	if err != nil {
+		return nil, false, err
+	}
+	if size == 0 && format == originalFormat && !original.Animated {
+		return original.Data, true, nil // Not stored as a variant, since it's the same as the original
+	}
+	resizedImage, resized := originalImage, false
+	if size > 0 && originalImage.Bounds().Dx() > size {
+		resizedImage, resized = imaging.Resize(originalImage, size, size, imaging.Lanczos), true
+	}
+	if !resized && format == originalFormat && !original.Animated {
+		data = original.Data
+	} else if size == 0 {
+		data, err = EncodeImage(ctx, resizedImage, format, 100)
+	} else {
+		data, err = EncodeImage(ctx, resizedImage, format, AVIF_QUALITY)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	stored, err := storeAvatarBlob(hash, name, data)
+	if err != nil {
+		return nil, false, err
+	} else if _, err = insertAvatarVariantStmt.Exec(hash, size, format, false, stored); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// PregenerateAvatarVariants generates the downscaled variants of a newly uploaded avatar in the
+// background, so the first requests for it don't have to wait. Animated variants are generated
+// from the frames of the uploaded animation, which is nil for static avatars.
+func PregenerateAvatarVariants(hash string, animation *AnimatedImage) {
+	go (func() {
+		for _, size := range avatarVariantSizes {
+			if animation != nil {
+				if err := createAnimatedAvatarVariant(hash, size, animation); err != nil {
+					slog.Error("Failed to generate animated avatar variant!", "error", err)
+				}
+			}
+			if _, _, err := GetAvatarVariant(hash, size, AvatarMasterFormat(), animation != nil); err != nil {
+				slog.Error("Failed to generate avatar variant!", "error", err)
+			}
+		}
+	})()
+}
+
+func createAnimatedAvatarVariant(hash string, size int, animation *AnimatedImage) error {
+	if animation.Frames[0].Bounds().Dx() > size {
+		animation = animation.Resize(size)
+	}
+	data, err := EncodeAnimation(context.Background(), animation, AvatarMasterFormat(), AVIF_QUALITY)
+	if err != nil {
+		return err
+	}
+	data, err = storeAvatarBlob(hash, avatarVariantBlob(size, AvatarMasterFormat(), true), data)
+	if err != nil {
+		return err
+	}
+	_, err = insertAvatarVariantStmt.Exec(hash, size, AvatarMasterFormat(), true, data)
+	return err
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/webp"
+)
+
+// ImageCodec encodes and decodes images in a single format. Quality ranges from 0 to 100, where 100
+// is lossless if the format supports it.
+type ImageCodec interface {
+	Encode(ctx context.Context, img image.Image, quality int) ([]byte, error)
+	Decode(ctx context.Context, data []byte) (image.Image, error)
+}
+
+// AnimatedImageCodec is implemented by codecs which can also encode animations.
+type AnimatedImageCodec interface {
+	EncodeAnimation(ctx context.Context, animation *AnimatedImage, quality int) ([]byte, error)
+}
+
+const (
+	// ImagePipelineLibavif uses avifenc/avifdec (and cwebp if installed) subprocesses, storing
+	// avatars as AVIF.
+	ImagePipelineLibavif = "libavif"
+	// ImagePipelineGo only uses in-process codecs, storing avatars as PNG. AVIF uploads are not
+	// supported, and avatars cannot be served as AVIF or WebP.
+	ImagePipelineGo = "go"
+)
+
+// Decoding an image larger than this could use gigabytes of memory, so such images are rejected
+// before decoding them (64 megapixels is 256 MB as RGBA).
+const maxImagePixels = 64 * 1024 * 1024
+
+var imageCodecs map[string]ImageCodec // By avatar format
+
+var imageCodecSemaphore chan struct{}
+
+// InitImageCodecs sets up the codecs of the configured image pipeline.
+func InitImageCodecs() {
+	imageCodecSemaphore = make(chan struct{}, config.Limits.ImageWorkers)
+	imageCodecs = map[string]ImageCodec{AvatarFormatPNG: pngCodec{}, AvatarFormatJPEG: jpegCodec{}}
+	if config.ImagePipeline == ImagePipelineLibavif {
+		if _, err := exec.LookPath("avifenc"); err != nil {
+			slog.Warn("Note: avifenc was not found, so avatars cannot be uploaded! Install libavif, " +
+				"or set imagePipeline to \"go\" in the config.")
+		}
+		imageCodecs[AvatarFormatAVIF] = avifCodec{}
+		if _, err := exec.LookPath("cwebp"); err == nil {
+			imageCodecs[AvatarFormatWebP] = webpCodec{}
+		}
+	}
+}
+
+// AvatarMasterFormat returns the format newly uploaded avatars are stored in.
+func AvatarMasterFormat() string {
+	if config.ImagePipeline == ImagePipelineGo {
+		return AvatarFormatPNG
+	}
+	return AvatarFormatAVIF
+}
+
+// runImageJob runs an encoding or decoding job once a worker is free, limiting it to the configured
+// image timeout.
+func runImageJob(ctx context.Context, job func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Limits.ImageTimeout)*time.Second)
+	defer cancel()
+	select {
+	case imageCodecSemaphore <- struct{}{}:
+		defer func() { <-imageCodecSemaphore }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := job(ctx); err != nil {
+		return err
+	}
+	return ctx.Err() // In-process codecs can't be interrupted, but their result is discarded
+}
+
+// EncodeImage encodes an image in the given avatar format.
+func EncodeImage(ctx context.Context, img image.Image, format string, quality int) ([]byte, error) {
+	codec, ok := imageCodecs[format]
+	if !ok {
+		return nil, errors.New("unsupported image format " + format)
+	}
+	var data []byte
+	err := runImageJob(ctx, func(ctx context.Context) (err error) {
+		start := time.Now()
+		data, err = codec.Encode(ctx, img, quality)
+		avatarEncodeDuration.Observe(time.Since(start).Seconds(), format, "false")
+		return
+	})
+	return data, err
+}
+
+// EncodeAnimation encodes an animation in the given avatar format, if it supports animations.
+func EncodeAnimation(ctx context.Context, animation *AnimatedImage, format string, quality int) ([]byte, error) {
+	codec, ok := imageCodecs[format].(AnimatedImageCodec)
+	if !ok {
+		return nil, errors.New("unsupported animated image format " + format)
+	}
+	var data []byte
+	err := runImageJob(ctx, func(ctx context.Context) (err error) {
+		start := time.Now()
+		data, err = codec.EncodeAnimation(ctx, animation, quality)
+		avatarEncodeDuration.Observe(time.Since(start).Seconds(), format, "true")
+		return
+	})
+	return data, err
+}
+
+// SupportsAnimation returns whether the configured image pipeline can encode animations in a format.
+func SupportsAnimation(format string) bool {
+	_, ok := imageCodecs[format].(AnimatedImageCodec)
+	return ok
+}
+
+// IsAnimatedAVIF returns whether AVIF data is an image sequence ('avis' brand) rather than a still.
+func IsAnimatedAVIF(data []byte) bool {
+	return len(data) >= 12 && string(data[4:12]) == "ftypavis"
+}
+
+var ErrImageTooLarge = errors.New("image dimensions are too large")
+
+// DecodeImage decodes an image in any supported format, after checking that its dimensions are
+// safe to decode. The format name returned matches image.Decode.
+func DecodeImage(ctx context.Context, data []byte) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	} else if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", ErrImageTooLarge
+	}
+	var img image.Image
+	err = runImageJob(ctx, func(ctx context.Context) (err error) {
+		if codec, ok := imageCodecs[format]; ok {
+			img, err = codec.Decode(ctx, data)
+		} else {
+			img, _, err = image.Decode(bytes.NewReader(data))
+		}
+		return
+	})
+	return img, format, err
+}
+
+func init() {
+	decodeAVIF := func(reader io.Reader) (image.Image, error) {
+		return nil, errors.New("decoding avif images requires the libavif image pipeline")
+	}
+	image.RegisterFormat("avif", "????ftypavif", decodeAVIF, DecodeAVIFConfig)
+	// Animated AVIF, avifdec decodes the first frame
+	image.RegisterFormat("avif", "????ftypavis", decodeAVIF, DecodeAVIFConfig)
+}
+
+// DecodeAVIFConfig reads the dimensions of an AVIF image from its image spatial extents ('ispe')
+// property, without decoding it.
+func DecodeAVIFConfig(reader io.Reader) (image.Config, error) {
+	header := make([]byte, 64*1024) // The metadata boxes come before the image data
+	n, err := io.ReadFull(reader, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return image.Config{}, err
+	}
+	// ispe boxes are laid out as size, "ispe", version and flags, width and height (all 32-bit)
+	index := bytes.Index(header[:n], []byte("ispe"))
+	if index < 4 || index+16 > n {
+		return image.Config{}, errors.New("avif image has no ispe property")
+	}
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      int(binary.BigEndian.Uint32(header[index+8:])),
+		Height:     int(binary.BigEndian.Uint32(header[index+12:])),
+	}, nil
+}
+
+// avifCodec encodes and decodes AVIF with the avifenc and avifdec subprocesses from libavif.
+type avifCodec struct{}
+
+func (avifCodec) Decode(ctx context.Context, data []byte) (image.Image, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "concinnity-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "input.avif"), filepath.Join(dir, "output.png")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+
+	// Decode to PNG and read back the data
+	var b bytes.Buffer
+	cmd := exec.CommandContext(ctx, "avifdec", "--png-compress", "0",
+		"--size-limit", strconv.Itoa(maxImagePixels), input, output)
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	if err := cmd.Run(); err != nil {
+		slog.ErrorContext(ctx, "avifdec error", "error", err, "output", b.String())
+		return nil, err
+	}
+	file, err := os.Open(output)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return png.Decode(file)
+}
+
+func (avifCodec) Encode(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "concinnity-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output.avif")
+
+	// Note: --stdin was added with libavif 1.4.0, so we can avoid creating a temporary PNG file.
+	// Note: -a c:tune=iq is default with libavif 1.4.0 in certain cases
+	args := []string{"-y", "444", "-d", "10", "-a", "c:tune=iq"}
+	if quality == 100 {
+		args = append(args, "-l")
+	} else {
+		args = append(args, "-q", strconv.Itoa(quality))
+	}
+	cmd := exec.CommandContext(ctx, "avifenc", append(args, "--stdin", "--input-format", "png", output)...)
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	writer, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	encodeErr := encoder.Encode(writer, img)
+	if closeErr := writer.Close(); encodeErr == nil {
+		encodeErr = closeErr
+	}
+	if encodeErr != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, encodeErr
+	}
+	if err = cmd.Wait(); err != nil {
+		slog.ErrorContext(ctx, "avifenc error", "error", err, "output", b.String())
+		return nil, err
+	}
+	return os.ReadFile(output)
+}
+
+func (avifCodec) EncodeAnimation(ctx context.Context, animation *AnimatedImage, quality int) ([]byte, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "concinnity-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output.avif")
+
+	// Each frame is written to a PNG file, preceded by its duration in milliseconds
+	args := []string{"-y", "444", "-d", "10", "-a", "c:tune=iq", "-q", strconv.Itoa(quality), "--timescale", "1000"}
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	for i, frame := range animation.Frames {
+		var frameData bytes.Buffer
+		input := filepath.Join(dir, "frame"+strconv.Itoa(i)+".png")
+		if err := encoder.Encode(&frameData, frame); err != nil {
+			return nil, err
+		} else if err := os.WriteFile(input, frameData.Bytes(), 0600); err != nil {
+			return nil, err
+		}
+		args = append(args, "--duration", strconv.FormatInt(animation.Durations[i].Milliseconds(), 10), input)
+	}
+	var b bytes.Buffer
+	cmd := exec.CommandContext(ctx, "avifenc", append(args, output)...)
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	if err = cmd.Run(); err != nil {
+		slog.ErrorContext(ctx, "avifenc error", "error", err, "output", b.String())
+		return nil, err
+	}
+	return os.ReadFile(output)
+}
+
+// webpCodec encodes WebP with the cwebp subprocess from libwebp, and decodes it in-process.
+type webpCodec struct{}
+
+func (webpCodec) Decode(ctx context.Context, data []byte) (image.Image, error) {
+	return webp.Decode(bytes.NewReader(data))
+}
+
+func (webpCodec) Encode(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "concinnity-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// cwebp cannot read PNG from stdin, so the image is written to a temporary file first
+	input, output := filepath.Join(dir, "input.png"), filepath.Join(dir, "output.webp")
+	var pngData bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&pngData, img); err != nil {
+		return nil, err
+	} else if err := os.WriteFile(input, pngData.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-quiet", "-q", strconv.Itoa(quality)}
+	if quality == 100 {
+		args = []string{"-quiet", "-lossless"}
+	}
+	var b bytes.Buffer
+	cmd := exec.CommandContext(ctx, "cwebp", append(args, input, "-o", output)...)
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	if err = cmd.Run(); err != nil {
+		slog.ErrorContext(ctx, "cwebp error", "error", err, "output", b.String())
+		return nil, err
+	}
+	return os.ReadFile(output)
+}
+
+// pngCodec encodes and decodes PNG in-process. PNG is always lossless.
+type pngCodec struct{}
+
+func (pngCodec) Decode(ctx context.Context, data []byte) (image.Image, error) {
+	return png.Decode(bytes.NewReader(data))
+}
+
+func (pngCodec) Encode(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	var b bytes.Buffer
+	err := png.Encode(&b, img)
+	return b.Bytes(), err
+}
+
+// jpegCodec encodes and decodes JPEG in-process. JPEG is never lossless.
+type jpegCodec struct{}
+
+func (jpegCodec) Decode(ctx context.Context, data []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+func (jpegCodec) Encode(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	// JPEG has no transparency, so transparent images are flattened onto white
+	background := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+	var b bytes.Buffer
+	err := jpeg.Encode(&b, imaging.Overlay(background, img, image.Pt(0, 0), 1), &jpeg.Options{Quality: quality})
+	return b.Bytes(), err
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type CommandReplyMessageOutgoing struct {
+	Type    string `json:"type"` // command_reply
+	Command string `json:"command"`
+	Data    string `json:"data"`
+	Error   bool   `json:"error"`
+}
+
+// ChatCommandContext carries the state of the connection which issued a chat command.
+type ChatCommandContext struct {
+	Room         *Room // Player state may be stale, use FindRoom if needed
+	User         *User
+	Members      RoomMembers
+	WriteChannel chan<- interface{}
+}
+
+// ChatCommandError is an error which is shown to the user issuing the command, as opposed to
+// other errors, which are treated as internal server errors.
+type ChatCommandError string
+
+func (e ChatCommandError) Error() string {
+	return string(e)
+}
+
+type ChatCommand struct {
+	Usage         string
+	Description   string
+	MinArgs       int
+	MaxArgs       int // -1 for unlimited
+	ModeratorOnly bool
+	// Handler returns the reply to send to the user issuing the command, if any.
+	Handler func(ctx *ChatCommandContext, args []string) (string, error)
+}
+
+var chatCommands map[string]*ChatCommand
+
+func init() {
+	// Initialised here to avoid an initialisation cycle with /help.
+	chatCommands = map[string]*ChatCommand{
+		"help": {
+			Usage:       "/help [command]",
+			Description: "Lists available commands, or shows the usage of a command.",
+			MaxArgs:     1,
+			Handler:     helpCommand,
+		},
+		"play": {
+			Usage:       "/play",
+			Description: "Resumes playback for everyone in the room.",
+			Handler:     playPauseCommand(false),
+		},
+		"pause": {
+			Usage:       "/pause",
+			Description: "Pauses playback for everyone in the room.",
+			Handler:     playPauseCommand(true),
+		},
+		"seek": {
+			Usage:       "/seek <[[hh:]mm:]ss | +seconds | -seconds>",
+			Description: "Seeks to a timestamp, or forwards/backwards by some seconds.",
+			MinArgs:     1,
+			MaxArgs:     1,
+			Handler:     seekCommand,
+		},
+		"speed": {
+			Usage:       "/speed <0.25-4>",
+			Description: "Changes the playback speed for everyone in the room.",
+			MinArgs:     1,
+			MaxArgs:     1,
+			Handler:     speedCommand,
+		},
+		"kick": {
+			Usage:         "/kick <username>",
+			Description:   "Removes a user from the room.",
+			MinArgs:       1,
+			MaxArgs:       1,
+			ModeratorOnly: true,
+			Handler:       kickCommand,
+		},
+		"ban": {
+			Usage:         "/ban <username> [duration] [reason]",
+			Description:   "Removes a user from the room and prevents them from rejoining (permanently by default).",
+			MinArgs:       1,
+			MaxArgs:       -1,
+			ModeratorOnly: true,
+			Handler:       banCommand,
+		},
+		"unban": {
+			Usage:         "/unban <username>",
+			Description:   "Allows a banned user to join the room again.",
+			MinArgs:       1,
+			MaxArgs:       1,
+			ModeratorOnly: true,
+			Handler:       unbanCommand,
+		},
+		"mute": {
+			Usage:         "/mute <username> [duration]",
+			Description:   "Prevents a user from chatting in the room (for 10m by default).",
+			MinArgs:       1,
+			MaxArgs:       2,
+			ModeratorOnly: true,
+			Handler:       muteCommand,
+		},
+		"unmute": {
+			Usage:         "/unmute <username>",
+			Description:   "Allows a muted user to chat in the room again.",
+			MinArgs:       1,
+			MaxArgs:       1,
+			ModeratorOnly: true,
+			Handler:       unmuteCommand,
+		},
+		"purge": {
+			Usage:         "/purge <username> [count]",
+			Description:   "Deletes a user's most recent messages in the room (50 by default).",
+			MinArgs:       1,
+			MaxArgs:       2,
+			ModeratorOnly: true,
+			Handler:       purgeCommand,
+		},
+		"slowmode": {
+			Usage:         "/slowmode <seconds | off>",
+			Description:   "Sets the minimum time between chat messages from each user.",
+			MinArgs:       1,
+			MaxArgs:       1,
+			ModeratorOnly: true,
+			Handler:       slowModeCommand,
+		},
+		"nick": {
+			Usage:       "/nick [nickname]",
+			Description: "Sets your nickname in this room, or clears it if none is given.",
+			MaxArgs:     -1,
+			Handler:     nickCommand,
+		},
+		"roll": {
+			Usage:       "/roll [NdM | max]",
+			Description: "Rolls dice (1d6 by default) and shares the result with the room.",
+			MaxArgs:     1,
+			Handler:     rollCommand,
+		},
+	}
+}
+
+// IsChatCommand returns whether a chat message should be handled as a command. Messages starting
+// with // are treated as regular messages, with the leading / escaping the second one.
+func IsChatCommand(msg string) bool {
+	return strings.HasPrefix(msg, "/") && !strings.HasPrefix(msg, "//")
+}
+
+// HandleChatCommand runs a chat command, sending any reply only to the connection which issued it.
+// Errors which are not ChatCommandErrors are returned to the caller to handle.
+func HandleChatCommand(ctx *ChatCommandContext, msg string) error {
+	args := strings.Fields(strings.TrimPrefix(msg, "/"))
+	if len(args) == 0 {
+		ctx.reply("", "Unknown command! Type /help for a list of commands.", true)
+		return nil
+	}
+	name, args := strings.ToLower(args[0]), args[1:]
+	command, ok := chatCommands[name]
+	if !ok {
+		ctx.reply(name, "Unknown command! Type /help for a list of commands.", true)
+		return nil
+	} else if command.ModeratorOnly && !ctx.Room.IsModerator(ctx.User.ID) {
+		ctx.reply(name, "You do not have permission to use this command!", true)
+		return nil
+	} else if len(args) < command.MinArgs || (command.MaxArgs >= 0 && len(args) > command.MaxArgs) {
+		ctx.reply(name, "Usage: "+command.Usage, true)
+		return nil
+	}
+
+	reply, err := command.Handler(ctx, args)
+	if cmdErr, ok := err.(ChatCommandError); ok {
+		ctx.reply(name, cmdErr.Error(), true)
+	} else if err != nil {
+		return err
+	} else if reply != "" {
+		ctx.reply(name, reply, false)
+	}
+	return nil
+}
+
+func (ctx *ChatCommandContext) reply(command string, msg string, isError bool) {
+	ctx.WriteChannel <- CommandReplyMessageOutgoing{
+		Type:    "command_reply",
+		Command: command,
+		Data:    msg,
+		Error:   isError,
+	}
+}
+
+// updatePlayerState applies a change to the room's current player state, then saves and
+// broadcasts it to every member of the room, including the issuing connection.
+func (ctx *ChatCommandContext) updatePlayerState(update func(state *PlayerStateMessageData)) error {
+	room, err := FindRoom(ctx.Room.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChatCommandError("Room not found!")
+	} else if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	state := PlayerStateMessageData{
+		Paused:     room.Paused,
+		Speed:      room.Speed,
+		Timestamp:  room.Timestamp,
+		LastAction: now,
+	}
+	if !room.Paused {
+		state.Timestamp += now.Sub(room.LastAction).Seconds() * room.Speed
+	}
+	update(&state)
+	state.Timestamp = max(state.Timestamp, 0)
+	if err := UpdateRoomState(room.ID, state); errors.Is(err, sql.ErrNoRows) {
+		return ChatCommandError("Room not found!")
+	} else if err != nil {
+		return err
+	}
+	ctx.Members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+		write <- PlayerStateMessageBi{Type: "player_state", Data: state}
+		return true
+	})
+	return nil
+}
+
+func helpCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	isModerator := ctx.Room.IsModerator(ctx.User.ID)
+	if len(args) == 1 {
+		command, ok := chatCommands[strings.ToLower(strings.TrimPrefix(args[0], "/"))]
+		if !ok || (command.ModeratorOnly && !isModerator) {
+			return "", ChatCommandError("Unknown command! Type /help for a list of commands.")
+		}
+		return command.Usage + " - " + command.Description, nil
+	}
+	names := make([]string, 0, len(chatCommands))
+	for name, command := range chatCommands {
+		if !command.ModeratorOnly || isModerator {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = chatCommands[name].Usage + " - " + chatCommands[name].Description
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func playPauseCommand(paused bool) func(ctx *ChatCommandContext, args []string) (string, error) {
+	return func(ctx *ChatCommandContext, args []string) (string, error) {
+		return "", ctx.updatePlayerState(func(state *PlayerStateMessageData) {
+			state.Paused = paused
+		})
+	}
+}
+
+func seekCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	relative := strings.HasPrefix(args[0], "+") || strings.HasPrefix(args[0], "-")
+	timestamp, err := ParseTimestamp(strings.TrimLeft(args[0], "+-"))
+	if err != nil {
+		return "", ChatCommandError("Invalid timestamp! Usage: " + chatCommands["seek"].Usage)
+	} else if strings.HasPrefix(args[0], "-") {
+		timestamp = -timestamp
+	}
+	return "", ctx.updatePlayerState(func(state *PlayerStateMessageData) {
+		if relative {
+			state.Timestamp += timestamp
+		} else {
+			state.Timestamp = timestamp
+		}
+	})
+}
+
+func speedCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "x"), 64)
+	if err != nil || !(speed >= 0.25 && speed <= 4) { // Also rejects NaN
+		return "", ChatCommandError("Speed must be a number between 0.25 and 4!")
+	}
+	return "", ctx.updatePlayerState(func(state *PlayerStateMessageData) {
+		state.Speed = speed
+	})
+}
+
+// findCommandTarget looks up the user a moderation command is targeting by their username.
+func (ctx *ChatCommandContext) findCommandTarget(username string) (*User, error) {
+	var target User
+	err := findUserByUsernameStmt.QueryRow(username).Scan(&target.Username, &target.Password,
+		&target.Email, &target.ID, &target.CreatedAt, &target.Verified, &target.Avatar)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ChatCommandError("No user with this username exists!")
+	} else if err != nil {
+		return nil, err
+	} else if target.ID == ctx.User.ID {
+		return nil, ChatCommandError("You cannot use this command on yourself!")
+	}
+	return &target, nil
+}
+
+func kickCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	target, err := ctx.findCommandTarget(args[0])
+	if err != nil {
+		return "", err
+	}
+	if kicked, err := KickFromRoom(ctx.Room.ID, ctx.User.ID, target.ID); err != nil {
+		return "", err
+	} else if !kicked {
+		return "", ChatCommandError("This user is not in the room!")
+	}
+	return "", nil
+}
+
+func banCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	target, err := ctx.findCommandTarget(args[0])
+	if err != nil {
+		return "", err
+	}
+	var duration time.Duration
+	if len(args) >= 2 {
+		if parsed, err := time.ParseDuration(args[1]); err == nil {
+			if parsed < time.Minute || parsed > maxRoomBanDuration {
+				return "", ChatCommandError("Ban duration must be between 1m and 8760h, e.g. 30m, 1h or 168h!")
+			}
+			duration = parsed
+			args = args[1:]
+		}
+	}
+	reason := strings.Join(args[1:], " ")
+	if len(reason) > maxRoomBanReasonLength {
+		return "", ChatCommandError("Ban reason cannot be longer than 200 characters!")
+	}
+	return "", BanFromRoom(ctx.Room.ID, ctx.User.ID, target.ID, reason, duration)
+}
+
+func unbanCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	target, err := ctx.findCommandTarget(args[0])
+	if err != nil {
+		return "", err
+	}
+	if unbanned, err := UnbanFromRoom(ctx.Room.ID, ctx.User.ID, target.ID); err != nil {
+		return "", err
+	} else if !unbanned {
+		return "", ChatCommandError("This user is not banned!")
+	}
+	return "", nil
+}
+
+func muteCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	target, err := ctx.findCommandTarget(args[0])
+	if err != nil {
+		return "", err
+	}
+	duration := 10 * time.Minute
+	if len(args) == 2 {
+		duration, err = time.ParseDuration(args[1])
+		if err != nil || duration < time.Second || duration > 30*24*time.Hour {
+			return "", ChatCommandError("Mute duration must be between 1s and 720h, e.g. 30s, 10m or 1h!")
+		}
+	}
+	expiresAt := time.Now().UTC().Add(duration)
+	if err := UpsertRoomMute(ctx.Room.ID, target.ID, expiresAt); err != nil {
+		return "", err
+	} else if err := InsertModerationLog(ctx.Room.ID, &ctx.User.ID, &target.ID,
+		"mute", "Muted for "+duration.String()); err != nil {
+		return "", err
+	}
+	SetMuteExpiry(ctx.Room.ID, target.ID, expiresAt)
+	return "", BroadcastSystemMessage(ctx.Room.ID, target.ID, "was muted for "+duration.String())
+}
+
+func unmuteCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	target, err := ctx.findCommandTarget(args[0])
+	if err != nil {
+		return "", err
+	} else if GetMuteExpiry(ctx.Room.ID, target.ID).IsZero() {
+		return "", ChatCommandError("This user is not muted!")
+	}
+	if _, err := deleteRoomMuteStmt.Exec(ctx.Room.ID, target.ID); err != nil {
+		return "", err
+	} else if err := InsertModerationLog(ctx.Room.ID, &ctx.User.ID, &target.ID, "unmute", ""); err != nil {
+		return "", err
+	}
+	SetMuteExpiry(ctx.Room.ID, target.ID, time.Time{})
+	return "", BroadcastSystemMessage(ctx.Room.ID, target.ID, "was unmuted")
+}
+
+func purgeCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	target, err := ctx.findCommandTarget(args[0])
+	if err != nil {
+		return "", err
+	}
+	count := 50
+	if len(args) == 2 {
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count < 1 || count > 500 {
+			return "", ChatCommandError("You can purge between 1 and 500 messages at once!")
+		}
+	}
+	ids, err := PurgeChatMessages(ctx.Room.ID, target.ID, count)
+	if err != nil {
+		return "", err
+	} else if len(ids) == 0 {
+		return "", ChatCommandError("This user has no messages in this room!")
+	} else if err := InsertModerationLog(ctx.Room.ID, &ctx.User.ID, &target.ID,
+		"purge", "Purged "+strconv.Itoa(len(ids))+" messages"); err != nil {
+		return "", err
+	}
+	ctx.Members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+		write <- ChatDeleteMessageOutgoing{Type: "chat_delete", Data: ids}
+		return true
+	})
+	return "Purged " + strconv.Itoa(len(ids)) + " messages.", nil
+}
+
+func slowModeCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	seconds := 0
+	if strings.ToLower(args[0]) != "off" {
+		var err error
+		seconds, err = strconv.Atoi(strings.TrimSuffix(args[0], "s"))
+		if err != nil || seconds < 0 || seconds > 3600 {
+			return "", ChatCommandError("Slow mode must be between 0 and 3600 seconds!")
+		}
+	}
+	result, err := updateRoomSlowModeStmt.Exec(seconds, ctx.Room.ID)
+	if err != nil {
+		return "", err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if rows != 1 {
+		return "", ChatCommandError("Room not found!")
+	}
+	roomSlowModes.Store(ctx.Room.ID, time.Duration(seconds)*time.Second)
+	if err := InsertModerationLog(ctx.Room.ID, &ctx.User.ID, nil,
+		"slowmode", strconv.Itoa(seconds)+" seconds"); err != nil {
+		return "", err
+	}
+	if seconds == 0 {
+		return "", BroadcastSystemMessage(ctx.Room.ID, ctx.User.ID, "disabled slow mode")
+	}
+	return "", BroadcastSystemMessage(ctx.Room.ID, ctx.User.ID,
+		"enabled slow mode ("+strconv.Itoa(seconds)+" seconds)")
+}
+
+func nickCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	nickname := strings.Join(args, " ")
+	if utf8.RuneCountInString(nickname) > 32 {
+		return "", ChatCommandError("Nicknames cannot be longer than 32 characters!")
+	} else if strings.IndexFunc(nickname, unicode.IsControl) != -1 {
+		return "", ChatCommandError("Nicknames cannot contain control characters!")
+	}
+	// Nicknames are shown to everyone like chat messages, so the same restrictions apply
+	if !ctx.Room.IsModerator(ctx.User.ID) {
+		if wait := CheckSlowMode(ctx.Room.ID, ctx.User.ID); wait > 0 {
+			return "", ChatCommandError("Slow mode is enabled in this room! Please wait " +
+				strconv.Itoa(int(wait.Seconds())+1) + " seconds before changing your nickname.")
+		}
+	}
+	if nickname != "" {
+		filtered, rejected, flagged, err := FilterChatMessage(ctx.Room.ID, nickname)
+		if err != nil {
+			return "", err
+		} else if rejected {
+			return "", ChatCommandError("Your nickname was blocked by this room's chat filter!")
+		} else if len(flagged) > 0 {
+			err = InsertModerationLog(ctx.Room.ID, nil, &ctx.User.ID, "flag",
+				"Nickname "+strconv.Quote(nickname)+" matched filters: "+strings.Join(flagged, ", "))
+			if err != nil {
+				return "", err
+			}
+		}
+		nickname = filtered
+	}
+	SetRoomNickname(ctx.Room.ID, ctx.User.ID, nickname)
+	var nicknameOrNil *string
+	if nickname != "" {
+		nicknameOrNil = &nickname
+	}
+	ctx.Members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+		write <- UserProfileUpdateMessageOutgoing{
+			Type: "user_profile_update",
+			ID:   ctx.User.ID,
+			Data: struct {
+				Nickname *string `json:"nickname"`
+			}{Nickname: nicknameOrNil},
+		}
+		return true
+	})
+	if nickname == "" {
+		return "Your nickname has been cleared.", nil
+	}
+	return "Your nickname is now " + nickname + ".", nil
+}
+
+func rollCommand(ctx *ChatCommandContext, args []string) (string, error) {
+	dice, sides := 1, 6
+	if len(args) == 1 {
+		var err error
+		if count, size, ok := strings.Cut(strings.ToLower(args[0]), "d"); ok {
+			if count != "" {
+				dice, err = strconv.Atoi(count)
+			}
+			if err == nil {
+				sides, err = strconv.Atoi(size)
+			}
+		} else {
+			sides, err = strconv.Atoi(args[0])
+		}
+		if err != nil || dice < 1 || dice > 100 || sides < 2 || sides > 1000000 {
+			return "", ChatCommandError("Invalid dice! Roll 1-100 dice with 2-1000000 sides, e.g. /roll 2d6")
+		}
+	}
+	results := make([]string, dice)
+	total := 0
+	for i := range results {
+		roll := rand.IntN(sides) + 1
+		total += roll
+		results[i] = strconv.Itoa(roll)
+	}
+	msg := "rolled " + strconv.Itoa(dice) + "d" + strconv.Itoa(sides) +
+		": " + strconv.Itoa(total)
+	if dice > 1 {
+		msg += " (" + strings.Join(results, ", ") + ")"
+	}
+	return "", BroadcastSystemMessage(ctx.Room.ID, ctx.User.ID, msg)
+}
+
+var timestampRegex = regexp.MustCompile(`^(\d+:){0,2}\d+(\.\d+)?$`)
+
+// ParseTimestamp parses a timestamp in [[hh:]mm:]ss format into seconds.
+func ParseTimestamp(timestamp string) (float64, error) {
+	if !timestampRegex.MatchString(timestamp) {
+		return 0, errors.New("invalid timestamp")
+	}
+	parts := strings.Split(timestamp, ":")
+	seconds := 0.0
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || (i > 0 && value >= 60) {
+			return 0, errors.New("invalid timestamp")
+		}
+		seconds = seconds*60 + value
+	}
+	return seconds, nil
+}
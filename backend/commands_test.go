@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		timestamp string
+		want      float64
+		wantErr   bool
+	}{
+		{"0", 0, false},
+		{"42", 42, false},
+		{"90", 90, false}, // Plain seconds are not limited to 60
+		{"1.5", 1.5, false},
+		{"1:30", 90, false},
+		{"01:02:03", 3723, false},
+		{"2:00:00.25", 7200.25, false},
+		{"1:60", 0, true},
+		{"1:60:00", 0, true},
+		{"1:2:3:4", 0, true},
+		{"", 0, true},
+		{"-5", 0, true},
+		{"1.5:00", 0, true},
+		{"1m30s", 0, true},
+		{" 10", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseTimestamp(test.timestamp)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseTimestamp(%q) error = %v, wantErr %v", test.timestamp, err, test.wantErr)
+		} else if got != test.want {
+			t.Errorf("ParseTimestamp(%q) = %v, want %v", test.timestamp, got, test.want)
+		}
+	}
+}
@@ -25,7 +25,9 @@ func IsAuthenticatedHTTP(w http.ResponseWriter, r *http.Request) (*User, *Token)
 		http.Error(w, errorJson("You are not logged in! Please sign in to continue."),
 			http.StatusUnauthorized)
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
+	} else {
+		setRequestUser(r.Context(), user.ID)
 	}
 	return user, token
 }
@@ -61,7 +63,7 @@ func StatusEndpoint(w http.ResponseWriter, r *http.Request) {
 	if errors.Is(err, ErrNotAuthenticated) {
 		w.Write([]byte("{\"online\":true,\"authenticated\":false}"))
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 	} else {
 		usernameJson, _ := json.Marshal(user.Username)
 		userIdJson, _ := json.Marshal(user.ID)
@@ -75,6 +77,40 @@ func StatusEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// InstanceLimits are the limits in LimitsConfig which clients can adapt their UI to.
+type InstanceLimits struct {
+	MaxRoomsPerUser      int `json:"maxRoomsPerUser"`
+	MaxPersistentRooms   int `json:"maxPersistentRooms"` // 0 for unlimited
+	PasswordResetTTL     int `json:"passwordResetTtl"`
+	MaxChatMessageLength int `json:"maxChatMessageLength"`
+	MaxSubtitleSize      int `json:"maxSubtitleSize"`
+	MaxAvatarSize        int `json:"maxAvatarSize"`
+	MaxAvatarResolution  int `json:"maxAvatarResolution"`
+	MaxAvatarFrames      int `json:"maxAvatarFrames"`
+	MaxAvatarDuration    int `json:"maxAvatarDuration"`
+}
+
+func GetInstanceEndpoint(w http.ResponseWriter, r *http.Request) {
+	// This endpoint does not require authentication
+	json.NewEncoder(w).Encode(struct {
+		Version string         `json:"version"`
+		Limits  InstanceLimits `json:"limits"`
+	}{
+		Version: version,
+		Limits: InstanceLimits{
+			MaxRoomsPerUser:      config.Limits.MaxRoomsPerUser,
+			MaxPersistentRooms:   config.MaxPersistentRooms,
+			PasswordResetTTL:     config.Limits.PasswordResetTTL,
+			MaxChatMessageLength: config.Limits.MaxChatMessageLength,
+			MaxSubtitleSize:      config.Limits.MaxSubtitleSize,
+			MaxAvatarSize:        config.Limits.MaxAvatarSize,
+			MaxAvatarResolution:  config.Limits.MaxAvatarResolution,
+			MaxAvatarFrames:      config.Limits.MaxAvatarFrames,
+			MaxAvatarDuration:    config.Limits.MaxAvatarDuration,
+		},
+	})
+}
+
 func LoginEndpoint(w http.ResponseWriter, r *http.Request) {
 	// Check the body for JSON containing username and password and return a token.
 	body, err := io.ReadAll(r.Body)
@@ -101,7 +137,7 @@ func LoginEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("No account with this username/email exists!"), http.StatusUnauthorized)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if !user.Verified {
 		http.Error(w, errorJson("Your account is not verified yet!"), http.StatusForbidden)
@@ -115,10 +151,10 @@ func LoginEndpoint(w http.ResponseWriter, r *http.Request) {
 	token := hex.EncodeToString(tokenBytes)
 	result, err := insertTokenStmt.Exec(token, time.Now().UTC(), user.ID)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 	// Add cookie to browser.
@@ -151,7 +187,7 @@ func LogoutEndpoint(w http.ResponseWriter, r *http.Request) {
 			http.StatusUnauthorized)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	// Disconnect existing sessions
@@ -217,7 +253,7 @@ func RegisterEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("An account with this e-mail already exists!"), http.StatusConflict)
 		return
 	} else if !errors.Is(err, sql.ErrNoRows) {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	err = findUserByUsernameStmt.QueryRow(data.Username).Scan(
@@ -226,23 +262,23 @@ func RegisterEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("An account with this username already exists!"), http.StatusConflict)
 		return
 	} else if !errors.Is(err, sql.ErrNoRows) {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	// Create the account.
 	hash := HashPassword(data.Password, GenerateSalt())
 	uuid, err := uuid.NewV7()
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	verified := true
 	result, err := createUserStmt.Exec(data.Username, hash, data.Email, uuid, verified)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 	w.Write([]byte("{\"success\":true,\"verified\":" + strconv.FormatBool(verified) + "}"))
@@ -261,7 +297,7 @@ func ForgotPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	tx, err := db.Begin()
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	defer tx.Rollback()
@@ -273,7 +309,7 @@ func ForgotPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("No account with this username/email exists!"), http.StatusUnauthorized)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	// Check if a password reset token was requested for this user in the last 2 minutes.
@@ -285,7 +321,7 @@ func ForgotPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 			http.StatusTooManyRequests)
 		return
 	} else if !errors.Is(err, sql.ErrNoRows) {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	// Insert a password reset token into the database.
@@ -293,12 +329,12 @@ func ForgotPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 	err = tx.Stmt(insertPasswordResetTokenStmt).QueryRow(user.ID).Scan(
 		&token.ID, &token.UserID, &token.CreatedAt)
 	if err != nil {
-		handleInternalServerError(w, err) // An account was already confirmed to exist with this email.
+		handleInternalServerError(w, r, err) // An account was already confirmed to exist with this email.
 		return
 	}
 	err = tx.Commit()
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	// Send the password reset email.
@@ -311,10 +347,11 @@ func ForgotPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 			"<a href=\""+config.FrontendURL+"/reset-password/"+token.ID.String()+"\">"+
 			config.FrontendURL+"/reset-password/"+token.ID.String()+
 			"</a><br>\n<br>\n"+
-			"As a security measure, this link will expire in 10 minutes."+
+			"As a security measure, this link will expire in "+
+			strconv.Itoa(config.Limits.PasswordResetTTL)+" minutes."+
 			"</p>")
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	w.Write([]byte("{\"success\":true}"))
@@ -340,9 +377,9 @@ func ForgotPasswordTokenEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("Invalid password reset token!"), http.StatusBadRequest)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
-	} else if response.CreatedAt.Add(10 * time.Minute).Before(time.Now().UTC()) {
+	} else if response.CreatedAt.Add(time.Duration(config.Limits.PasswordResetTTL) * time.Minute).Before(time.Now().UTC()) {
 		http.Error(w, errorJson("This password reset token has expired!"), http.StatusBadRequest)
 		return
 	}
@@ -375,7 +412,7 @@ func ResetPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 	// Delete the token and update the user's password.
 	tx, err := db.Begin()
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	defer tx.Rollback()
@@ -387,12 +424,12 @@ func ResetPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("Invalid password reset token!"), http.StatusBadRequest)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
-	} else if token.CreatedAt.Add(10 * time.Minute).Before(time.Now().UTC()) {
+	} else if token.CreatedAt.Add(time.Duration(config.Limits.PasswordResetTTL) * time.Minute).Before(time.Now().UTC()) {
 		err = tx.Commit() // Delete the token to prevent reuse.
 		if err != nil {
-			handleInternalServerError(w, err)
+			handleInternalServerError(w, r, err)
 			return
 		}
 		http.Error(w, errorJson("This password reset token has expired!"), http.StatusBadRequest)
@@ -400,15 +437,15 @@ func ResetPasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	result, err := tx.Stmt(updateUserPasswordStmt).Exec(hashedPassword, token.UserID)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 	err = tx.Commit()
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	w.Write([]byte("{\"success\":true}"))
@@ -450,10 +487,10 @@ func ChangePasswordEndpoint(w http.ResponseWriter, r *http.Request) {
 	hashedPassword := HashPassword(data.NewPassword, GenerateSalt())
 	result, err := updateUserPasswordStmt.Exec(hashedPassword, token.UserID)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 	w.Write([]byte("{\"success\":true}"))
@@ -486,24 +523,13 @@ func DeleteAccountEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	result, err := deleteUserStmt.Exec(token.UserID)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
-		return
-	}
-	// Delete old avatar
-	if user.Avatar != nil {
-		_, err := deleteAvatarStmt.Exec(*user.Avatar)
-		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23503" {
-			// Do nothing
-		} else if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1451 {
-			// Do nothing
-		} else if err != nil {
-			handleInternalServerError(w, err)
-			return
-		}
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
+		return
 	}
+	// The user's avatar is deleted by CollectOrphanedAvatars once it is no longer used
 	w.Write([]byte("{\"success\":true}"))
 }
 
@@ -552,10 +578,10 @@ func ChangeUsernameEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("An account with this username already exists!"), http.StatusConflict)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 
@@ -610,10 +636,10 @@ func ChangeEmailEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("An account with this e-mail already exists!"), http.StatusConflict)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 	w.Write([]byte("{\"success\":true}"))
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+type ChatSearchResult struct {
+	ChatMessage
+	Snippet []ChatSearchSnippetPart `json:"snippet"`
+}
+
+// ChatSearchSnippetPart is a part of a message excerpt, where Match marks the highlighted parts.
+type ChatSearchSnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+const chatSearchSnippetLength = 200 // Runes
+
+type ExportedChatMessage struct {
+	ChatMessage
+	Username string `json:"username"` // Rendered into the message for system messages
+	System   bool   `json:"system"`
+}
+
+const chatExportBatchSize = 100
+const chatExportWriteTimeout = 30 * time.Second // Per batch, so slow clients cannot stall an export forever
+
+func SearchChatEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	terms := searchTerms(query.Get("q"))
+	var author uuid.NullUUID
+	var from, to sql.NullTime
+	limit, offset := 25, 0
+	var err error
+	if len(terms) == 0 {
+		http.Error(w, errorJson("Search query cannot be empty!"), http.StatusBadRequest)
+		return
+	} else if len(terms) > 16 {
+		http.Error(w, errorJson("Search query is too long!"), http.StatusBadRequest)
+		return
+	}
+	if query.Get("author") != "" {
+		if author.UUID, err = uuid.Parse(query.Get("author")); err != nil {
+			http.Error(w, errorJson("Invalid author ID!"), http.StatusBadRequest)
+			return
+		}
+		author.Valid = true
+	}
+	if query.Get("from") != "" {
+		if from.Time, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+			http.Error(w, errorJson("Invalid from date! Dates must be in RFC 3339 format."), http.StatusBadRequest)
+			return
+		}
+		from.Valid = true
+	}
+	if query.Get("to") != "" {
+		if to.Time, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			http.Error(w, errorJson("Invalid to date! Dates must be in RFC 3339 format."), http.StatusBadRequest)
+			return
+		}
+		to.Valid = true
+	}
+	if query.Get("limit") != "" {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > 100 {
+			http.Error(w, errorJson("Limit must be between 1 and 100!"), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("offset") != "" {
+		if offset, err = strconv.Atoi(query.Get("offset")); err != nil || offset < 0 {
+			http.Error(w, errorJson("Invalid offset!"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	room := findMemberRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	// Fetch an extra message to know if there are more results
+	chat, err := SearchChatMessages(room.ID, terms, author, from, to, limit+1, offset)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	hasMore := len(chat) > limit
+	chat = chat[:min(len(chat), limit)]
+	results := make([]ChatSearchResult, len(chat))
+	for i, msg := range chat {
+		results[i] = ChatSearchResult{ChatMessage: msg, Snippet: highlightSearchTerms(msg.Message, terms)}
+	}
+	json.NewEncoder(w).Encode(struct {
+		Results []ChatSearchResult `json:"results"`
+		HasMore bool               `json:"hasMore"`
+	}{Results: results, HasMore: hasMore})
+}
+
+// searchTerms splits a search query into lowercase words, dropping any other characters.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// highlightSearchTerms returns an excerpt of a message around the first word starting with any of
+// the search terms, split into parts marking such words.
+func highlightSearchTerms(message string, terms []string) []ChatSearchSnippetPart {
+	// Find the byte ranges of every matching word
+	var matches [][2]int
+	wordStart := -1
+	for i, r := range message + " " {
+		isWordChar := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordChar && wordStart == -1 {
+			wordStart = i
+		} else if !isWordChar && wordStart != -1 {
+			word := strings.ToLower(message[wordStart:i])
+			for _, term := range terms {
+				if strings.HasPrefix(word, term) {
+					matches = append(matches, [2]int{wordStart, i})
+					break
+				}
+			}
+			wordStart = -1
+		}
+	}
+
+	// Pick a window of the message around the first match
+	start, end := 0, len(message)
+	if utf8.RuneCountInString(message) > chatSearchSnippetLength {
+		if len(matches) > 0 {
+			start = matches[0][0]
+			for range chatSearchSnippetLength / 4 { // Include some context before the match
+				if start == 0 {
+					break
+				}
+				_, size := utf8.DecodeLastRuneInString(message[:start])
+				start -= size
+			}
+		}
+		end = start
+		for range chatSearchSnippetLength {
+			if end == len(message) {
+				break
+			}
+			_, size := utf8.DecodeRuneInString(message[end:])
+			end += size
+		}
+	}
+
+	parts := make([]ChatSearchSnippetPart, 0)
+	if start > 0 {
+		parts = append(parts, ChatSearchSnippetPart{Text: "…"})
+	}
+	position := start
+	for _, match := range matches {
+		if match[1] <= start || match[0] >= end {
+			continue
+		}
+		matchStart, matchEnd := max(match[0], start), min(match[1], end)
+		if matchStart > position {
+			parts = append(parts, ChatSearchSnippetPart{Text: message[position:matchStart]})
+		}
+		parts = append(parts, ChatSearchSnippetPart{Text: message[matchStart:matchEnd], Match: true})
+		position = matchEnd
+	}
+	if position < end {
+		parts = append(parts, ChatSearchSnippetPart{Text: message[position:end]})
+	}
+	if end < len(message) {
+		parts = append(parts, ChatSearchSnippetPart{Text: "…"})
+	}
+	return parts
+}
+
+func ExportChatEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	var contentType string
+	switch format {
+	case "json", "":
+		format, contentType = "json", "application/json"
+	case "txt":
+		contentType = "text/plain; charset=utf-8"
+	case "html":
+		contentType = "text/html; charset=utf-8"
+	default:
+		http.Error(w, errorJson("Invalid format! Supported formats: json, txt, html"), http.StatusBadRequest)
+		return
+	}
+	room := findMemberRoom(w, r, user)
+	if room == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=\"concinnity-"+room.ID+"-chat."+format+"\"")
+	exportedAt := time.Now().UTC()
+	if err := writeChatExportHeader(w, format, room, exportedAt); err != nil {
+		return // The client has likely disconnected
+	}
+	profiles := make(map[uuid.UUID]UserProfile)
+	first := true
+	controller := http.NewResponseController(w)
+	err := StreamChatMessagesByRoom(room.ID, chatExportBatchSize, func(batch []ChatMessage) error {
+		_ = controller.SetWriteDeadline(time.Now().Add(chatExportWriteTimeout))
+		// Resolve any new user IDs in this batch to usernames
+		unknownIds := make([]uuid.UUID, 0)
+		for _, msg := range batch {
+			id := msg.UserID
+			if msg.SubjectID != nil {
+				id = *msg.SubjectID
+			}
+			if _, ok := profiles[id]; !ok && id != uuid.Nil && !slices.Contains(unknownIds, id) {
+				unknownIds = append(unknownIds, id)
+			}
+		}
+		newProfiles, err := FindUserProfiles(unknownIds)
+		if err != nil {
+			return err
+		}
+		for _, id := range unknownIds {
+			if profile, ok := newProfiles[id]; ok {
+				profiles[id] = profile
+			} else {
+				profiles[id] = UserProfile{Username: "Deleted user"}
+			}
+		}
+
+		for _, msg := range batch {
+			exported := ExportedChatMessage{ChatMessage: msg, System: msg.UserID == uuid.Nil}
+			if exported.System {
+				exported.Username = "system"
+				if msg.SubjectID != nil {
+					exported.Message = profiles[*msg.SubjectID].Username + " " + msg.Message
+				}
+			} else {
+				exported.Username = profiles[msg.UserID].Username
+			}
+			if err := writeChatExportMessage(w, format, exported, first); err != nil {
+				return err
+			}
+			first = false
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers have already been sent, so the response is simply cut short
+		slog.ErrorContext(r.Context(), "Internal Server Error!", "error", err)
+		return
+	}
+	writeChatExportFooter(w, format)
+}
+
+func writeChatExportHeader(w io.Writer, format string, room *Room, exportedAt time.Time) error {
+	var err error
+	switch format {
+	case "json":
+		roomIdJson, _ := json.Marshal(room.ID)
+		exportedAtJson, _ := json.Marshal(exportedAt)
+		_, err = io.WriteString(w, "{\"roomId\":"+string(roomIdJson)+
+			",\"exportedAt\":"+string(exportedAtJson)+",\"messages\":[")
+	case "txt":
+		_, err = io.WriteString(w, "Chat history of room "+room.ID+
+			", exported at "+exportedAt.Format(time.RFC1123)+"\n\n")
+	case "html":
+		title := html.EscapeString("Chat history of room " + room.ID)
+		_, err = io.WriteString(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+			"<title>"+title+"</title>\n"+
+			"<style>body{font-family:sans-serif}time{color:gray}.system{color:gray;font-style:italic}</style>\n"+
+			"</head>\n<body>\n<h1>"+title+"</h1>\n"+
+			"<p>Exported at "+html.EscapeString(exportedAt.Format(time.RFC1123))+"</p>\n")
+	}
+	return err
+}
+
+func writeChatExportMessage(w io.Writer, format string, msg ExportedChatMessage, first bool) error {
+	var err error
+	timestamp := msg.Timestamp.UTC().Format("2006-01-02 15:04:05")
+	switch format {
+	case "json":
+		if !first {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		err = json.NewEncoder(w).Encode(msg)
+	case "txt":
+		if msg.System {
+			_, err = io.WriteString(w, "["+timestamp+"] * "+msg.Message+"\n")
+		} else {
+			_, err = io.WriteString(w, "["+timestamp+"] "+msg.Username+": "+msg.Message+"\n")
+		}
+	case "html":
+		if msg.System {
+			_, err = io.WriteString(w, "<p class=\"system\"><time>"+timestamp+"</time> "+
+				html.EscapeString(msg.Message)+"</p>\n")
+		} else {
+			_, err = io.WriteString(w, "<p><time>"+timestamp+"</time> <b>"+html.EscapeString(msg.Username)+
+				"</b>: "+strings.ReplaceAll(html.EscapeString(msg.Message), "\n", "<br>")+"</p>\n")
+		}
+	}
+	return err
+}
+
+func writeChatExportFooter(w io.Writer, format string) {
+	switch format {
+	case "json":
+		io.WriteString(w, "]}\n")
+	case "html":
+		io.WriteString(w, "</body>\n</html>\n")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms("  Hello, WORLD! it's 2024 ")
+	want := []string{"hello", "world", "it", "s", "2024"}
+	if !slices.Equal(got, want) {
+		t.Errorf("searchTerms() = %q, want %q", got, want)
+	}
+}
+
+func TestHighlightSearchTerms(t *testing.T) {
+	part := func(text string) ChatSearchSnippetPart { return ChatSearchSnippetPart{Text: text} }
+	match := func(text string) ChatSearchSnippetPart { return ChatSearchSnippetPart{Text: text, Match: true} }
+	tests := []struct {
+		name    string
+		message string
+		terms   []string
+		want    []ChatSearchSnippetPart
+	}{
+		{"no match", "hello there", []string{"bye"}, []ChatSearchSnippetPart{part("hello there")}},
+		{"whole words by prefix", "Watching the watchers, unwatched", []string{"watch"}, []ChatSearchSnippetPart{
+			match("Watching"), part(" the "), match("watchers"), part(", unwatched"),
+		}},
+		{"several terms", "movie night: popcorn!", []string{"pop", "movie"}, []ChatSearchSnippetPart{
+			match("movie"), part(" night: "), match("popcorn"), part("!"),
+		}},
+		{"unicode words", "Ça va, ça?", []string{"ça"}, []ChatSearchSnippetPart{
+			match("Ça"), part(" va, "), match("ça"), part("?"),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := highlightSearchTerms(test.message, test.terms); !slices.Equal(got, test.want) {
+				t.Errorf("highlightSearchTerms() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHighlightSearchTermsExcerpt(t *testing.T) {
+	filler := strings.Repeat("é ", chatSearchSnippetLength) // Multi-byte runes, so cuts must respect them
+	message := filler + "needle " + filler
+	got := highlightSearchTerms(message, []string{"needle"})
+	if len(got) < 3 || got[0].Text != "…" || got[len(got)-1].Text != "…" {
+		t.Fatalf("highlightSearchTerms() = %+v, want an excerpt with ellipses at both ends", got)
+	}
+	text, matches := "", 0
+	for _, part := range got[1 : len(got)-1] {
+		if !utf8.ValidString(part.Text) {
+			t.Errorf("part %q is not valid UTF-8", part.Text)
+		}
+		if part.Match {
+			matches++
+			if part.Text != "needle" {
+				t.Errorf("matched %q, want needle", part.Text)
+			}
+		}
+		text += part.Text
+	}
+	if n := utf8.RuneCountInString(text); n != chatSearchSnippetLength {
+		t.Errorf("excerpt is %d runes long, want %d", n, chatSearchSnippetLength)
+	} else if matches != 1 {
+		t.Errorf("excerpt has %d matches, want 1", matches)
+	} else if !strings.HasPrefix(text, strings.Repeat("é ", chatSearchSnippetLength/8)+"needle") {
+		t.Errorf("excerpt %q does not start with context before the match", text)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Public rooms are sorted and paginated in memory, so only this many of the newest rooms matching a
+// search are listed, and every sort order only applies to them (e.g. sorting by members shows the
+// most popular of the newest rooms). Older rooms can still be found by searching for them.
+const maxPublicRoomListings = 1000
+
+func GetRoomsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if user, _ := IsAuthenticatedHTTP(w, r); user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	limit, offset := 25, 0
+	var err error
+	if query.Get("limit") != "" {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > 100 {
+			http.Error(w, errorJson("Limit must be between 1 and 100!"), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("offset") != "" {
+		if offset, err = strconv.Atoi(query.Get("offset")); err != nil || offset < 0 {
+			http.Error(w, errorJson("Invalid offset!"), http.StatusBadRequest)
+			return
+		}
+	}
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "members"
+	} else if sort != "members" && sort != "created" && sort != "active" {
+		http.Error(w, errorJson("Invalid sort! Supported: members, created, active"), http.StatusBadRequest)
+		return
+	}
+
+	search := "%" + likeEscaper.Replace(strings.ToLower(strings.TrimSpace(query.Get("q")))) + "%"
+	rooms, err := FindRoomListings(findPublicRoomsStmt, false, search, search)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	truncated := len(rooms) > maxPublicRoomListings
+	if truncated {
+		rooms = rooms[:maxPublicRoomListings]
+	}
+	// Member counts are only known in memory, so sorting and pagination happen here
+	slices.SortStableFunc(rooms, func(a, b RoomListing) int {
+		switch sort {
+		case "members":
+			if c := cmp.Compare(b.MemberCount, a.MemberCount); c != 0 {
+				return c
+			}
+			return b.ModifiedAt.Compare(a.ModifiedAt)
+		case "active":
+			return b.ModifiedAt.Compare(a.ModifiedAt)
+		default:
+			return b.CreatedAt.Compare(a.CreatedAt)
+		}
+	})
+	total := len(rooms)
+	start, end := min(offset, total), total
+	if offset < total-limit { // offset+limit could overflow
+		end = offset + limit
+	}
+	json.NewEncoder(w).Encode(struct {
+		Rooms     []RoomListing `json:"rooms"`
+		Total     int           `json:"total"`
+		Truncated bool          `json:"truncated"` // If more rooms matched than can be listed
+	}{Rooms: rooms[start:end], Total: total, Truncated: truncated})
+}
+
+func GetOwnRoomsEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	owned, err := FindRoomListings(findOwnedRoomsStmt, false, user.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	recent, err := FindRoomListings(findRecentRoomsStmt, true, user.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Owned  []RoomListing `json:"owned"`
+		Recent []RoomListing `json:"recent"`
+	}{Owned: owned, Recent: recent})
+}
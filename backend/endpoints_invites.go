@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	nanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// Invite links contain the invite's ID, which is long enough that it cannot be guessed. Redeeming
+// an invite checks its room, expiry and uses in the database.
+const inviteIdLength = 21
+
+func GetRoomInvitesEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	invites, err := FindRoomInvites(room.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	for i := range invites {
+		invites[i].Token = invites[i].ID
+	}
+	json.NewEncoder(w).Encode(invites)
+}
+
+func CreateRoomInviteEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		ExpiresIn int `json:"expiresIn"` // Seconds, 0 for never
+		MaxUses   int `json:"maxUses"`   // 0 for unlimited
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	} else if data.ExpiresIn < 0 || data.ExpiresIn > 60*60*24*365 {
+		http.Error(w, errorJson("Invites cannot expire in more than a year!"), http.StatusBadRequest)
+		return
+	} else if data.MaxUses < 0 {
+		http.Error(w, errorJson("Invalid maximum uses!"), http.StatusBadRequest)
+		return
+	}
+
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	id := nanoid.Must(inviteIdLength)
+	invite := RoomInvite{ID: id, Token: id, CreatorID: &user.ID, MaxUses: data.MaxUses}
+	if data.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(data.ExpiresIn) * time.Second)
+		invite.ExpiresAt = &expiresAt
+	}
+	err = insertRoomInviteStmt.QueryRow(invite.ID, room.ID, invite.CreatorID, invite.ExpiresAt, invite.MaxUses).
+		Scan(&invite.CreatedAt)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(invite)
+}
+
+func DeleteRoomInviteEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+
+	result, err := deleteRoomInviteStmt.Exec(r.PathValue("inviteId"), room.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows, err := result.RowsAffected(); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows != 1 {
+		http.Error(w, errorJson("Invite not found!"), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("{\"success\":true}"))
+}
+
+func RedeemRoomInviteEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	inviteId, _, _ := strings.Cut(data.Token, ".") // Older invite links had a signature after the ID
+	if inviteId == "" {
+		http.Error(w, errorJson("Invalid invite link!"), http.StatusBadRequest)
+		return
+	}
+
+	room, err := FindRoom(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if !checkRoomBan(w, r, &room, user) {
+		return
+	}
+
+	// Existing members don't use up the invite
+	if member, err := IsRoomMember(id, user.ID); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if member {
+		w.Write([]byte("{\"success\":true}"))
+		return
+	}
+	result, err := useRoomInviteStmt.Exec(inviteId, id)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows, err := result.RowsAffected(); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows != 1 {
+		http.Error(w, errorJson("This invite link is invalid, has expired or has reached its maximum uses!"),
+			http.StatusGone)
+		return
+	}
+	if _, err = upsertRoomMemberStmt.Exec(id, user.ID); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	w.Write([]byte("{\"success\":true}"))
+}
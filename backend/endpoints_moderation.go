@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// findModeratedRoom returns the room in the request path if the user can moderate it, otherwise
+// it responds with an error and returns nil.
+func findModeratedRoom(w http.ResponseWriter, r *http.Request, user *User) *Room {
+	room, err := FindRoom(r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Room not found!"), http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return nil
+	} else if !room.IsModerator(user.ID) {
+		http.Error(w, errorJson("You are not a moderator of this room!"), http.StatusForbidden)
+		return nil
+	}
+	return &room
+}
+
+func GetRoomFiltersEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	filters, err := FindRoomFilters(room.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(filters)
+}
+
+func CreateRoomFilterEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var filter ChatFilter
+	if err = json.Unmarshal(body, &filter); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	} else if err = filter.Compile(); err != nil {
+		http.Error(w, errorJson("Invalid chat filter! Actions can be mask, reject or flag, and "+
+			"patterns must be 1-200 characters long and valid regular expressions if regex is true."),
+			http.StatusBadRequest)
+		return
+	}
+
+	err = insertRoomFilterStmt.QueryRow(room.ID, filter.Pattern, filter.Regex, filter.Action).Scan(&filter.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	roomFilters.Delete(room.ID)
+	err = InsertModerationLog(room.ID, &user.ID, nil, "filter_add", filter.Action+": "+filter.Pattern)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	w.Write([]byte("{\"id\":" + strconv.Itoa(filter.ID) + "}"))
+}
+
+func DeleteRoomFilterEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	filterId, err := strconv.Atoi(r.PathValue("filterId"))
+	if err != nil {
+		http.Error(w, errorJson("Invalid filter ID!"), http.StatusBadRequest)
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+
+	result, err := deleteRoomFilterStmt.Exec(filterId, room.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows, err := result.RowsAffected(); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows != 1 {
+		http.Error(w, errorJson("Filter not found!"), http.StatusNotFound)
+		return
+	}
+	roomFilters.Delete(room.ID)
+	err = InsertModerationLog(room.ID, &user.ID, nil, "filter_remove", "Filter #"+strconv.Itoa(filterId))
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	w.Write([]byte("{\"success\":true}"))
+}
+
+func GetModerationLogEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	logs, err := FindModerationLogs(room.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(logs)
+}
+
+// findModerationTarget parses the user ID in the request path, refusing the room's moderators.
+func findModerationTarget(w http.ResponseWriter, r *http.Request, room *Room) (uuid.UUID, bool) {
+	userId, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		http.Error(w, errorJson("Invalid user ID!"), http.StatusBadRequest)
+		return uuid.Nil, false
+	} else if room.IsModerator(userId) {
+		http.Error(w, errorJson("You cannot use this on a moderator!"), http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return userId, true
+}
+
+func KickRoomMemberEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	userId, ok := findModerationTarget(w, r, room)
+	if !ok {
+		return
+	}
+	if kicked, err := KickFromRoom(room.ID, user.ID, userId); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if !kicked {
+		http.Error(w, errorJson("This user is not in the room!"), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("{\"success\":true}"))
+}
+
+func GetRoomBansEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	bans, err := FindRoomBans(room.ID)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(bans)
+}
+
+func BanRoomMemberEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		Reason   string `json:"reason"`
+		Duration int    `json:"duration"` // Seconds, 0 for permanent
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	duration := time.Duration(data.Duration) * time.Second
+	if data.Duration < 0 || (duration > 0 && duration < time.Minute) || duration > maxRoomBanDuration {
+		http.Error(w, errorJson("Ban duration must be between 1 minute and 1 year!"), http.StatusBadRequest)
+		return
+	} else if len(data.Reason) > maxRoomBanReasonLength {
+		http.Error(w, errorJson("Ban reason cannot be longer than 200 characters!"), http.StatusBadRequest)
+		return
+	}
+
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	userId, ok := findModerationTarget(w, r, room)
+	if !ok {
+		return
+	}
+	err = BanFromRoom(room.ID, user.ID, userId, strings.TrimSpace(data.Reason), duration)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, errorJson("User not found!"), http.StatusNotFound)
+		return
+	} else if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1452 {
+		http.Error(w, errorJson("User not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	w.Write([]byte("{\"success\":true}"))
+}
+
+func UnbanRoomMemberEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findModeratedRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	userId, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		http.Error(w, errorJson("Invalid user ID!"), http.StatusBadRequest)
+		return
+	}
+	if unbanned, err := UnbanFromRoom(room.ID, user.ID, userId); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if !unbanned {
+		http.Error(w, errorJson("This user is not banned!"), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("{\"success\":true}"))
+}
@@ -7,6 +7,11 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/lib/pq"
@@ -14,9 +19,60 @@ import (
 )
 
 type roomEndpointBody struct {
-	ID     string `json:"id"`
-	Type   string `json:"type"`
-	Target string `json:"target"`
+	ID            string  `json:"id"`
+	Type          string  `json:"type"`
+	Target        string  `json:"target"`
+	KeepSubtitles bool    `json:"keepSubtitles"` // Only used when updating
+	Persistent    *bool   `json:"persistent"`
+	Visibility    *string `json:"visibility"`
+	Password      *string `json:"password"` // Empty to remove the password
+	Title         *string `json:"title"`
+	Description   *string `json:"description"`
+
+	fields map[string]json.RawMessage // Used to tell which fields are being updated
+}
+
+func (b *roomEndpointBody) has(field string) bool {
+	_, ok := b.fields[field]
+	return ok
+}
+
+type subtitleMetadataBody struct {
+	Name     *string `json:"name"`
+	Language *string `json:"language"`
+	Label    *string `json:"label"`
+	Forced   *bool   `json:"forced"`
+	SDH      *bool   `json:"sdh"`
+}
+
+var languageTagRegex = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// validateSubtitleMetadata returns an error message if the user-editable metadata is invalid.
+func validateSubtitleMetadata(metadata *SubtitleMetadata) string {
+	if metadata.Name == "" || len(metadata.Name) > 200 {
+		return errorJson("Name must be 1-200 characters long!")
+	} else if metadata.Language != "" &&
+		(len(metadata.Language) > 35 || !languageTagRegex.MatchString(metadata.Language)) {
+		return errorJson("Language must be a valid BCP 47 language tag, e.g. en or pt-BR!")
+	} else if len(metadata.Label) > 200 {
+		return errorJson("Label cannot be longer than 200 characters!")
+	}
+	return ""
+}
+
+// canEditSubtitle returns whether a user can rename or remove a subtitle, which only the user who
+// last uploaded it and the room's moderators can.
+func canEditSubtitle(room *Room, user *User, metadata *SubtitleMetadata) bool {
+	return room.IsModerator(user.ID) || (metadata.UploaderID != nil && *metadata.UploaderID == user.ID)
+}
+
+func broadcastSubtitleMessage(roomId string, msg SubtitleMessageOutgoing) {
+	if members, ok := roomMembers.Load(roomId); ok {
+		members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+			write <- msg
+			return true
+		})
+	}
 }
 
 func readRoomEndpointBody(r *http.Request, data *roomEndpointBody) string {
@@ -25,18 +81,31 @@ func readRoomEndpointBody(r *http.Request, data *roomEndpointBody) string {
 		return errorJson("Unable to read body!")
 	}
 	err = json.Unmarshal(body, data)
+	if err == nil {
+		err = json.Unmarshal(body, &data.fields)
+	}
 	if err != nil {
 		return errorJson("Unable to read body!")
 	} else if data.Type != "" && data.Type != "local_file" && data.Type != "remote_file" {
 		return errorJson("Invalid room type!")
 	} else if data.Type != "" && data.Target == "" {
 		return errorJson("Target cannot be empty with room type '" + data.Type + "'!")
+	} else if data.Visibility != nil && *data.Visibility != RoomVisibilityPublic &&
+		*data.Visibility != RoomVisibilityUnlisted && *data.Visibility != RoomVisibilityPrivate {
+		return errorJson("Invalid room visibility! Supported: public, unlisted, private")
+	} else if data.Password != nil && len(*data.Password) > 128 {
+		return errorJson("Room password cannot be longer than 128 characters!")
+	} else if data.Title != nil && utf8.RuneCountInString(*data.Title) > 100 {
+		return errorJson("Room title cannot be longer than 100 characters!")
+	} else if data.Description != nil && utf8.RuneCountInString(*data.Description) > 1000 {
+		return errorJson("Room description cannot be longer than 1000 characters!")
 	}
 	return ""
 }
 
 func CreateRoomEndpoint(w http.ResponseWriter, r *http.Request) {
-	if user, _ := IsAuthenticatedHTTP(w, r); user == nil {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
 		return
 	}
 
@@ -54,7 +123,30 @@ func CreateRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := insertRoomStmt.Exec(id, body.Type, body.Target)
+	persistent := body.Persistent != nil && *body.Persistent
+	if persistent && !checkPersistentRoomLimit(w, r, user) {
+		return
+	}
+	visibility := RoomVisibilityUnlisted
+	if body.Visibility != nil {
+		visibility = *body.Visibility
+	}
+	var password *string
+	if body.Password != nil && *body.Password != "" {
+		hash := HashPassword(*body.Password, GenerateSalt())
+		password = &hash
+	}
+
+	var title, description string
+	if body.Title != nil {
+		title = strings.TrimSpace(*body.Title)
+	}
+	if body.Description != nil {
+		description = strings.TrimSpace(*body.Description)
+	}
+
+	result, err := insertRoomStmt.Exec(id, body.Type, body.Target, user.ID, persistent, visibility, password,
+		title, description)
 	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
 		http.Error(w, errorJson("Room ID already exists!"), http.StatusConflict)
 		return
@@ -62,46 +154,125 @@ func CreateRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("Room ID already exists!"), http.StatusConflict)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	w.Write([]byte("{\"id\":\"" + id + "\"}"))
 }
 
 func GetRoomEndpoint(w http.ResponseWriter, r *http.Request) {
-	if user, _ := IsAuthenticatedHTTP(w, r); user == nil {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
 		return
 	}
 
-	room := Room{}
-	err := findRoomStmt.QueryRow(r.PathValue("id")).Scan(
-		&room.ID, &room.CreatedAt, &room.ModifiedAt, &room.Type, &room.Target,
-		&room.Paused, &room.Speed, &room.Timestamp, &room.LastAction)
-	if errors.Is(err, sql.ErrNoRows) {
-		http.Error(w, errorJson("Room not found!"), http.StatusNotFound)
-		return
-	} else if err != nil {
-		handleInternalServerError(w, err)
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
 		return
 	}
+	var err error
 	room.Chat, err = FindChatMessagesByRoom(room.ID)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
-	room.Subtitles, err = FindSubtitlesByRoom(room.ID)
+	room.SubtitleMetadata, err = FindSubtitlesByRoom(room.ID)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
+	room.Subtitles = make([]string, len(room.SubtitleMetadata))
+	for i, subtitle := range room.SubtitleMetadata {
+		room.Subtitles[i] = subtitle.Name
+	}
 	json.NewEncoder(w).Encode(room)
 }
 
+// findAccessibleRoom returns the room in the request path if the user can access it, otherwise it
+// responds with an error and returns nil.
+func findAccessibleRoom(w http.ResponseWriter, r *http.Request, user *User) *Room {
+	room, err := FindRoom(r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Room not found!"), http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return nil
+	}
+	if !checkRoomBan(w, r, &room, user) {
+		return nil
+	}
+	if ok, err := CanAccessRoom(&room, user.ID); err != nil {
+		handleInternalServerError(w, r, err)
+		return nil
+	} else if !ok && room.Visibility == RoomVisibilityPrivate {
+		http.Error(w, errorJson("This room is private! You need an invite to join it."), http.StatusForbidden)
+		return nil
+	} else if !ok {
+		http.Error(w, errorJson("This room is password protected! Join it with the password first."),
+			http.StatusForbidden)
+		return nil
+	}
+	return &room
+}
+
+// findMemberRoom returns the room in the request path if the user can access it and has joined it
+// or redeemed an invite to it, or owns it, otherwise it responds with an error and returns nil. Room
+// history is limited to members, even in public rooms.
+func findMemberRoom(w http.ResponseWriter, r *http.Request, user *User) *Room {
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return nil
+	} else if room.IsModerator(user.ID) {
+		return room
+	}
+	if member, err := IsRoomMember(room.ID, user.ID); err != nil {
+		handleInternalServerError(w, r, err)
+		return nil
+	} else if !member {
+		http.Error(w, errorJson("You are not a member of this room! Join it first."), http.StatusForbidden)
+		return nil
+	}
+	return room
+}
+
+// checkRoomBan returns whether the user is not banned from the room, otherwise it responds with an
+// error. Moderators cannot be locked out of their own rooms.
+func checkRoomBan(w http.ResponseWriter, r *http.Request, room *Room, user *User) bool {
+	if ban, err := FindRoomBan(room.ID, user.ID); err == nil && !room.IsModerator(user.ID) {
+		http.Error(w, errorJson(ban.Message()), http.StatusForbidden)
+		return false
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		handleInternalServerError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// checkPersistentRoomLimit returns whether the user can own another persistent room, otherwise it
+// responds with an error.
+func checkPersistentRoomLimit(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if config.MaxPersistentRooms <= 0 {
+		return true
+	}
+	var count int
+	if err := countPersistentRoomsStmt.QueryRow(user.ID).Scan(&count); err != nil {
+		handleInternalServerError(w, r, err)
+		return false
+	} else if count >= config.MaxPersistentRooms {
+		http.Error(w, errorJson("You cannot own more than "+strconv.Itoa(config.MaxPersistentRooms)+
+			" persistent rooms!"), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func UpdateRoomEndpoint(w http.ResponseWriter, r *http.Request) {
-	if user, _ := IsAuthenticatedHTTP(w, r); user == nil {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
 		return
 	}
 
@@ -111,13 +282,68 @@ func UpdateRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := r.PathValue("id")
-	createdAt, modifiedAt, err := UpdateRoom(id, body.Type, body.Target)
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	id := room.ID
+	if body.Persistent != nil || body.Visibility != nil || body.Password != nil ||
+		body.Title != nil || body.Description != nil {
+		if room.OwnerID == nil || *room.OwnerID != user.ID {
+			http.Error(w, errorJson("Only the room's owner can change its settings!"), http.StatusForbidden)
+			return
+		} else if body.Persistent != nil && *body.Persistent && !room.Persistent &&
+			!checkPersistentRoomLimit(w, r, user) {
+			return
+		}
+	}
+	if body.Persistent != nil {
+		if _, err := updateRoomPersistentStmt.Exec(*body.Persistent, id); err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+	}
+	if body.Visibility != nil {
+		if _, err := updateRoomVisibilityStmt.Exec(*body.Visibility, id); err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+	}
+	if body.Title != nil || body.Description != nil {
+		title, description := room.Title, room.Description
+		if body.Title != nil {
+			title = strings.TrimSpace(*body.Title)
+		}
+		if body.Description != nil {
+			description = strings.TrimSpace(*body.Description)
+		}
+		if _, err := updateRoomDetailsStmt.Exec(title, description, id); err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+	}
+	if body.Password != nil {
+		var password *string
+		if *body.Password != "" {
+			hash := HashPassword(*body.Password, GenerateSalt())
+			password = &hash
+		}
+		if _, err := updateRoomPasswordStmt.Exec(password, id); err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+	}
+	if !body.has("type") && !body.has("target") {
+		w.Write([]byte("{\"success\":true}"))
+		return
+	}
+
+	createdAt, modifiedAt, err := UpdateRoom(id, body.Type, body.Target, body.KeepSubtitles)
 	if err == sql.ErrNoRows {
 		http.Error(w, errorJson("Room not found!"), http.StatusNotFound)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	// Send message to all room members about the change
@@ -136,52 +362,123 @@ func UpdateRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 			return true
 		})
 	}
+	if body.KeepSubtitles {
+		subtitles, err := FindSubtitlesByRoom(id)
+		if err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+		broadcastSubtitleMessage(id, NewSubtitleMessage(subtitles, nil))
+	}
 	w.Write([]byte("{\"success\":true}"))
 }
 
 func GetRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
-	if user, _ := IsAuthenticatedHTTP(w, r); user == nil {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
 		return
 	} else if r.URL.Query().Get("name") == "" {
 		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
 		return
 	}
+	format, ok := readSubtitleFormat(w, r)
+	if !ok {
+		return
+	}
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
 
 	var subtitle string
-	err := findSubtitleStmt.QueryRow(r.PathValue("id"), r.URL.Query().Get("name")).Scan(&subtitle)
+	var original sql.NullString
+	var originalFormat string
+	err := findSubtitleStmt.QueryRow(room.ID, r.URL.Query().Get("name")).Scan(
+		&subtitle, &original, &originalFormat)
 	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
-	w.Write([]byte(subtitle))
+	writeSubtitle(w, r, format, subtitle, original, originalFormat)
+}
+
+// writeSubtitle serves a subtitle as WebVTT, or in its original format if explicitly requested
+// or if the client prefers its format over WebVTT.
+func writeSubtitle(
+	w http.ResponseWriter, r *http.Request, format string,
+	subtitle string, original sql.NullString, originalFormat string,
+) {
+	if format == "" {
+		w.Header().Set("Vary", "Accept")
+		accept := r.Header.Get("Accept")
+		originalContentType, _, _ := strings.Cut(SubtitleContentTypes[originalFormat], ";")
+		if !strings.Contains(accept, "text/vtt") && strings.Contains(accept, originalContentType) {
+			format = "original"
+		}
+	}
+	if format == "original" && original.Valid {
+		w.Header().Set("Content-Type", SubtitleContentTypes[originalFormat])
+		w.Write([]byte(original.String))
+	} else {
+		w.Header().Set("Content-Type", SubtitleContentTypes[SubtitleFormatWebVTT])
+		w.Write([]byte(subtitle))
+	}
 }
 
 func CreateRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
-	if user, _ := IsAuthenticatedHTTP(w, r); user == nil {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
 		return
-	} else if r.URL.Query().Get("name") == "" {
-		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+	}
+	query := r.URL.Query()
+	metadata := SubtitleMetadata{
+		Name:       query.Get("name"),
+		Language:   query.Get("language"),
+		Label:      query.Get("label"),
+		UploaderID: &user.ID,
+		Forced:     query.Get("forced") == "true",
+		SDH:        query.Get("sdh") == "true",
+	}
+	if err := validateSubtitleMetadata(&metadata); err != "" {
+		http.Error(w, err, http.StatusBadRequest)
 		return
 	}
 
-	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024)) // 1 MB limit
+	maxSize := int64(config.Limits.MaxSubtitleSize) * 1024
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
 	if err != nil || len(body) == 0 {
 		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
 		return
-	} else if len(body) == 1024*1024 {
+	} else if int64(len(body)) == maxSize {
 		http.Error(w, errorJson("Body too large!"), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	var result sql.Result
-	if config.Database == "mysql" {
-		result, err = insertSubtitleStmt.Exec(r.PathValue("id"), r.URL.Query().Get("name"), body, body)
-	} else {
-		result, err = insertSubtitleStmt.Exec(r.PathValue("id"), r.URL.Query().Get("name"), body)
+	// Validate the subtitles and convert them to WebVTT
+	original, err := DecodeSubtitleText(body)
+	if err != nil {
+		http.Error(w, errorJson("Subtitles must be a UTF-8 or UTF-16 text file!"), http.StatusBadRequest)
+		return
+	}
+	subtitle, errs := ParseSubtitle(original)
+	if len(errs) > 0 {
+		errorsJson, _ := json.Marshal(struct {
+			Error  string          `json:"error"`
+			Errors []SubtitleError `json:"errors"`
+		}{Error: "Invalid subtitles! Supported formats: SRT, WebVTT, ASS/SSA, TTML", Errors: errs})
+		http.Error(w, string(errorsJson), http.StatusBadRequest)
+		return
 	}
+	metadata.CueCount = len(subtitle.Cues)
+
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	err = UpsertSubtitle(room.ID, &metadata, subtitle.WebVTT(), original, subtitle.Format)
 	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Class() == "23503" {
 		http.Error(w, errorJson("Room does not exist!"), http.StatusNotFound)
 		return
@@ -189,20 +486,555 @@ func CreateRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorJson("Room does not exist!"), http.StatusNotFound)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
-		return
-	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 
 	// Send message to all room members about the change
-	if members, ok := roomMembers.Load(r.PathValue("id")); ok {
-		members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
-			write <- SubtitleMessageOutgoing{Type: "subtitle", Data: []string{r.URL.Query().Get("name")}}
-			return true
-		})
+	broadcastSubtitleMessage(room.ID, NewSubtitleMessage([]SubtitleMetadata{metadata}, nil))
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func UpdateRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var data subtitleMetadataBody
+	if err = json.Unmarshal(body, &data); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	id, name := room.ID, r.URL.Query().Get("name")
+	metadata, err := FindSubtitleMetadata(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if !canEditSubtitle(room, user, &metadata) {
+		http.Error(w, errorJson("Only the subtitle's uploader and moderators can edit it!"),
+			http.StatusForbidden)
+		return
+	}
+	if data.Name != nil {
+		metadata.Name = *data.Name
+	}
+	if data.Language != nil {
+		metadata.Language = *data.Language
+	}
+	if data.Label != nil {
+		metadata.Label = *data.Label
+	}
+	if data.Forced != nil {
+		metadata.Forced = *data.Forced
+	}
+	if data.SDH != nil {
+		metadata.SDH = *data.SDH
+	}
+	if err := validateSubtitleMetadata(&metadata); err != "" {
+		http.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := updateSubtitleMetadataStmt.Exec(metadata.Name, metadata.Language, metadata.Label,
+		metadata.Forced, metadata.SDH, id, name)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, errorJson("A subtitle with this name already exists!"), http.StatusConflict)
+		return
+	} else if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		http.Error(w, errorJson("A subtitle with this name already exists!"), http.StatusConflict)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows, err := result.RowsAffected(); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows != 1 {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	}
+
+	var removed []string
+	if metadata.Name != name {
+		removed = []string{name}
+	}
+	broadcastSubtitleMessage(id, NewSubtitleMessage([]SubtitleMetadata{metadata}, removed))
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func DeleteRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
 	}
 
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	id, name := room.ID, r.URL.Query().Get("name")
+	metadata, err := FindSubtitleMetadata(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if !canEditSubtitle(room, user, &metadata) {
+		http.Error(w, errorJson("Only the subtitle's uploader and moderators can remove it!"),
+			http.StatusForbidden)
+		return
+	}
+	result, err := deleteSubtitleStmt.Exec(id, name)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows, err := result.RowsAffected(); err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if rows != 1 {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	}
+
+	broadcastSubtitleMessage(id, NewSubtitleMessage([]SubtitleMetadata{}, []string{name}))
 	w.Write([]byte("{\"success\":true}"))
 }
+
+type subtitleRetimeBody struct {
+	Offset *float64            `json:"offset"` // Seconds
+	Points []subtitleSyncPoint `json:"points"`
+}
+
+// subtitleSyncPoint maps a time in the subtitle to the time in the media it should appear at.
+type subtitleSyncPoint struct {
+	From float64 `json:"from"` // Seconds
+	To   float64 `json:"to"`   // Seconds
+}
+
+func RetimeRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var data subtitleRetimeBody
+	if err = json.Unmarshal(body, &data); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	// Shift by a constant offset, or stretch linearly between two sync points
+	var from, to time.Duration
+	scale := 1.0
+	if data.Offset != nil && data.Points == nil {
+		if !(*data.Offset >= -3600 && *data.Offset <= 3600) {
+			http.Error(w, errorJson("Offset must be between -3600 and 3600 seconds!"), http.StatusBadRequest)
+			return
+		}
+		to = time.Duration(*data.Offset * float64(time.Second))
+	} else if data.Offset == nil && len(data.Points) == 2 {
+		p1, p2 := data.Points[0], data.Points[1]
+		scale = (p2.To - p1.To) / (p2.From - p1.From)
+		if p1.From < 0 || p1.To < 0 || p2.From < 0 || p2.To < 0 || p1.From == p2.From ||
+			!(scale >= 0.5 && scale <= 2) {
+			http.Error(w, errorJson("Sync points must be non-negative, distinct, and stretch the "+
+				"subtitles by no more than 2x!"), http.StatusBadRequest)
+			return
+		}
+		from = time.Duration(p1.From * float64(time.Second))
+		to = time.Duration(p1.To * float64(time.Second))
+	} else {
+		http.Error(w, errorJson("Either an offset or two sync points must be specified!"), http.StatusBadRequest)
+		return
+	}
+
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	id, name := room.ID, r.URL.Query().Get("name")
+	metadata, err := FindSubtitleMetadata(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	var stored string
+	var original sql.NullString
+	var originalFormat string
+	err = findSubtitleStmt.QueryRow(id, name).Scan(&stored, &original, &originalFormat)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	subtitle, errs := ParseSubtitle(stored)
+	if len(errs) > 0 {
+		handleInternalServerError(w, r, errors.New("failed to parse stored subtitle: "+errs[0].Message))
+		return
+	}
+
+	// The retimed subtitle replaces the original, since the original's timings are now outdated
+	subtitle.Retime(from, to, scale)
+	retimed := subtitle.WebVTT()
+	metadata.UploaderID = &user.ID
+	metadata.CueCount = len(subtitle.Cues)
+	err = UpsertSubtitle(id, &metadata, retimed, retimed, SubtitleFormatWebVTT)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+
+	broadcastSubtitleMessage(id, NewSubtitleMessage([]SubtitleMetadata{metadata}, nil))
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func GetRoomEmbeddedSubtitlesEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	mediaUrl, ok := MediaURLFromTarget(room.Type, room.Target)
+	if !ok {
+		http.Error(w, errorJson("Embedded subtitles can only be read from remote files over HTTP(S)!"),
+			http.StatusBadRequest)
+		return
+	} else if !IsFFmpegAvailable() {
+		http.Error(w, errorJson("Embedded subtitles are not supported on this server!"), http.StatusNotImplemented)
+		return
+	}
+	if !checkMediaProbe(w, r, user, mediaUrl) {
+		return
+	}
+
+	streams, _, err := ProbeSubtitleStreams(r.Context(), mediaUrl)
+	if err != nil {
+		http.Error(w, errorJson("Failed to read the room's media!"), http.StatusBadGateway)
+		return
+	}
+	var job *SubtitleExtractionJob
+	if existing, ok := subtitleExtractionJobs.Load(room.ID); ok {
+		job = &existing
+	}
+	json.NewEncoder(w).Encode(struct {
+		Streams []EmbeddedSubtitle     `json:"streams"`
+		Job     *SubtitleExtractionJob `json:"job"`
+	}{Streams: streams, Job: job})
+}
+
+func ExtractRoomEmbeddedSubtitlesEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		Streams []int `json:"streams"`
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		http.Error(w, errorJson("Unable to read body!"), http.StatusBadRequest)
+		return
+	} else if len(data.Streams) == 0 || len(data.Streams) > 16 {
+		http.Error(w, errorJson("Between 1 and 16 streams must be selected!"), http.StatusBadRequest)
+		return
+	}
+
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	mediaUrl, ok := MediaURLFromTarget(room.Type, room.Target)
+	if !ok {
+		http.Error(w, errorJson("Embedded subtitles can only be read from remote files over HTTP(S)!"),
+			http.StatusBadRequest)
+		return
+	} else if !IsFFmpegAvailable() {
+		http.Error(w, errorJson("Embedded subtitles are not supported on this server!"), http.StatusNotImplemented)
+		return
+	} else if job, ok := subtitleExtractionJobs.Load(room.ID); ok && job.Status == SubtitleExtractionRunning {
+		http.Error(w, errorJson("Subtitles are already being extracted in this room!"), http.StatusConflict)
+		return
+	}
+	if !checkMediaProbe(w, r, user, mediaUrl) {
+		return
+	}
+
+	// Re-probe the media, since the client's stream list may be outdated
+	streams, duration, err := ProbeSubtitleStreams(r.Context(), mediaUrl)
+	if err != nil {
+		http.Error(w, errorJson("Failed to read the room's media!"), http.StatusBadGateway)
+		return
+	}
+	selected := make([]EmbeddedSubtitle, 0, len(data.Streams))
+	for _, index := range data.Streams {
+		i := slices.IndexFunc(streams, func(stream EmbeddedSubtitle) bool { return stream.Index == index })
+		if i == -1 || !streams[i].Extractable {
+			http.Error(w, errorJson("Stream "+strconv.Itoa(index)+" is not an extractable subtitle!"),
+				http.StatusBadRequest)
+			return
+		} else if !slices.ContainsFunc(selected, func(s EmbeddedSubtitle) bool { return s.Index == index }) {
+			selected = append(selected, streams[i])
+		}
+	}
+
+	job, ok := StartSubtitleExtraction(room.ID, user, mediaUrl, selected, duration)
+	if !ok {
+		http.Error(w, errorJson("Subtitles are already being extracted in this room!"), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// checkMediaProbe returns whether the user can have the room's media probed, otherwise it responds
+// with an error. Every probe makes the server read the media, so they are rate limited.
+func checkMediaProbe(w http.ResponseWriter, r *http.Request, user *User, mediaUrl string) bool {
+	if ok, retryAfter := GetUserRateLimits(user.ID).MediaProbe.Take(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, errorJson("You are reading the room's media too often! Please try again later."),
+			http.StatusTooManyRequests)
+		return false
+	}
+	if err := CheckMediaHost(r.Context(), mediaUrl); errors.Is(err, ErrPrivateMediaHost) {
+		http.Error(w, errorJson("Embedded subtitles cannot be read from media on a private network!"),
+			http.StatusBadRequest)
+		return false
+	} else if err != nil {
+		http.Error(w, errorJson("Failed to read the room's media!"), http.StatusBadGateway)
+		return false
+	}
+	return true
+}
+
+// readSubtitleFormat returns the subtitle format requested in the query, or responds with an error
+// and returns false if it is invalid.
+func readSubtitleFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "original" && format != SubtitleFormatWebVTT {
+		http.Error(w, errorJson("Invalid format! Supported formats: vtt, original"), http.StatusBadRequest)
+		return "", false
+	}
+	return format, true
+}
+
+func GetRoomSubtitleVersionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
+	}
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	versions, err := FindSubtitleVersions(room.ID, r.URL.Query().Get("name"))
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	} else if len(versions) == 0 {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(versions)
+}
+
+func GetRoomSubtitleVersionEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
+	}
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, errorJson("Invalid version!"), http.StatusBadRequest)
+		return
+	}
+	format, ok := readSubtitleFormat(w, r)
+	if !ok {
+		return
+	}
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+
+	var subtitle string
+	var original sql.NullString
+	var originalFormat string
+	var cueCount int
+	err = findSubtitleVersionStmt.QueryRow(room.ID, r.URL.Query().Get("name"), version).Scan(
+		&subtitle, &original, &originalFormat, &cueCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitle version or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	writeSubtitle(w, r, format, subtitle, original, originalFormat)
+}
+
+func RevertRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
+	}
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		http.Error(w, errorJson("Invalid version!"), http.StatusBadRequest)
+		return
+	}
+
+	room := findModeratedRoom(w, r, user) // Reverting can undo other users' changes
+	if room == nil {
+		return
+	}
+	id, name := room.ID, r.URL.Query().Get("name")
+	metadata, err := FindSubtitleMetadata(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	var subtitle string
+	var original sql.NullString
+	var originalFormat string
+	err = findSubtitleVersionStmt.QueryRow(id, name, version).Scan(
+		&subtitle, &original, &originalFormat, &metadata.CueCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitle version not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+
+	// Reverting saves the old version as a new one, so the history is never rewritten
+	metadata.UploaderID = &user.ID
+	if !original.Valid {
+		original.String, originalFormat = subtitle, SubtitleFormatWebVTT
+	}
+	err = UpsertSubtitle(id, &metadata, subtitle, original.String, originalFormat)
+	if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	broadcastSubtitleMessage(id, NewSubtitleMessage([]SubtitleMetadata{metadata}, nil))
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func DiffRoomSubtitleEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, _ := IsAuthenticatedHTTP(w, r)
+	if user == nil {
+		return
+	} else if r.URL.Query().Get("name") == "" {
+		http.Error(w, errorJson("Name cannot be empty!"), http.StatusBadRequest)
+		return
+	}
+
+	// Compare the given versions, defaulting to the latest version and the one before it
+	room := findAccessibleRoom(w, r, user)
+	if room == nil {
+		return
+	}
+	id, name := room.ID, r.URL.Query().Get("name")
+	metadata, err := FindSubtitleMetadata(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("Subtitles or room not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	to := metadata.Version
+	if r.URL.Query().Get("to") != "" {
+		if to, err = strconv.Atoi(r.URL.Query().Get("to")); err != nil {
+			http.Error(w, errorJson("Invalid version!"), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to - 1
+	if r.URL.Query().Get("from") != "" {
+		if from, err = strconv.Atoi(r.URL.Query().Get("from")); err != nil {
+			http.Error(w, errorJson("Invalid version!"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	subtitles := make([]*Subtitle, 2)
+	for i, version := range []int{from, to} {
+		var data, originalFormat string
+		var original sql.NullString
+		var cueCount int
+		err = findSubtitleVersionStmt.QueryRow(id, name, version).Scan(
+			&data, &original, &originalFormat, &cueCount)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, errorJson("Subtitle version "+strconv.Itoa(version)+" not found!"),
+				http.StatusNotFound)
+			return
+		} else if err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+		var errs []SubtitleError
+		if subtitles[i], errs = ParseSubtitle(data); len(errs) > 0 {
+			handleInternalServerError(w, r, errors.New("failed to parse stored subtitle: "+errs[0].Message))
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+		SubtitleDiff
+	}{From: from, To: to, SubtitleDiff: DiffSubtitles(subtitles[0], subtitles[1])})
+}
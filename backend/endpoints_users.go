@@ -2,22 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"image"
 	"io"
 	"net/http"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
-	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
-	"github.com/lib/pq"
 
 	_ "image/gif"
 	_ "image/jpeg"
@@ -35,59 +34,116 @@ const AVIF_QUALITY = 85
 
 var VALID_AVATAR_SIZES = []string{"", "256", "4096"}
 
+// Sizes of the downscaled avatar variants, as opposed to the original avatar (?size=4096)
+var avatarVariantSizes = []int{256}
+
+// parseAvatarQuery parses the size and format query parameters of an avatar request, negotiating
+// the format with the Accept header if omitted, and writes an error response if they are invalid.
+func parseAvatarQuery(w http.ResponseWriter, r *http.Request) (size int, format string, ok bool) {
+	if !slices.Contains(VALID_AVATAR_SIZES, r.URL.Query().Get("size")) {
+		http.Error(w, errorJson("Invalid size parameter! Supported sizes: 256, 4096"),
+			http.StatusBadRequest)
+		return 0, "", false
+	}
+	// If ?size=256, serve the downscaled variant, otherwise for 4096, return the original lossless image
+	if r.URL.Query().Get("size") == "256" {
+		size = 256
+	}
+	// Serve the format requested with ?format, else negotiate it with the Accept header
+	format = strings.ToLower(r.URL.Query().Get("format"))
+	if format == "jpg" {
+		format = AvatarFormatJPEG
+	}
+	if format == "" {
+		w.Header().Set("Vary", "Accept")
+		if format = NegotiateAvatarFormat(r.Header.Get("Accept")); format == "" {
+			http.Error(w, errorJson("No acceptable avatar format! Supported formats: AVIF, WebP, PNG, JPEG"),
+				http.StatusNotAcceptable)
+			return 0, "", false
+		}
+	} else if !IsAvatarFormatSupported(format) {
+		http.Error(w, errorJson("Invalid or unsupported format parameter! Supported formats: avif, webp, png, jpeg"),
+			http.StatusBadRequest)
+		return 0, "", false
+	}
+	return size, format, true
+}
+
 func GetAvatarEndpoint(w http.ResponseWriter, r *http.Request) {
 	// This endpoint does not require authentication
-	if len(r.PathValue("hash")) != 64 {
+	hash := r.PathValue("hash")
+	if len(hash) != 64 {
 		http.Error(w, errorJson("Invalid avatar hash!"), http.StatusBadRequest)
 		return
-	} else if !slices.Contains(VALID_AVATAR_SIZES, r.URL.Query().Get("size")) {
-		http.Error(w, errorJson("Invalid size parameter! Supported sizes: 256, 4096"),
-			http.StatusBadRequest)
+	}
+	size, format, ok := parseAvatarQuery(w, r)
+	if !ok {
+		return
+	}
+	// ?static=true requests the first frame of animated avatars
+	static := r.URL.Query().Get("static") == "true"
+	// Avatars never change, so a client revalidating its cached copy can always keep using it
+	etag := "\"" + hash + "-" + strconv.Itoa(size) + "-" + format + "\""
+	if static {
+		etag = "\"" + hash + "-" + strconv.Itoa(size) + "-" + format + "-static\""
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	// Retrieve avatar from the database
-	// Assumptions: Every avatar is 1:1 aspect ratio, 4096x4096 max resolution, AVIF format
-	var avatar Avatar
-	err := findAvatarByHashStmt.QueryRow(r.PathValue("hash")).Scan(
-		&avatar.Hash, &avatar.Data, &avatar.CreatedAt)
+	data, complete, err := GetAvatarVariant(hash, size, format, static)
 	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, errorJson("Avatar not found!"), http.StatusNotFound)
 		return
 	} else if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
-	// If ?size=256, downscale the avatar, otherwise for 4096, return the original lossless image
-	data := avatar.Data
-	// if size, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil && size < 4096 {
-	if r.URL.Query().Get("size") == "256" {
-		size := 256
-		// Decode original image
-		originalImage, err := DecodeAVIF(bytes.NewReader(avatar.Data))
-		if err != nil {
-			http.Error(w, errorJson("Failed to decode avatar image!"), http.StatusUnprocessableEntity)
-			return
-		}
-		// Resize image
-		resizedImage := originalImage
-		if originalImage.Bounds().Dx() > size {
-			resizedImage = imaging.Resize(originalImage, size, size, imaging.Lanczos)
-			// Encode image
-			data, err = EncodeAVIF(resizedImage, AVIF_QUALITY)
-			if err != nil {
-				handleInternalServerError(w, err)
-				return
-			}
-		}
-	}
 	// Return the avatar
-	w.Header().Set("Content-Type", "image/avif")
-	http.ServeContent(w, r, avatar.Hash+".avif", avatar.CreatedAt, bytes.NewReader(data))
+	w.Header().Set("Content-Type", avatarContentTypes[format])
+	if complete {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", etag)
+	} else { // A placeholder for a variant which is still being generated
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.Header().Set("X-Avatar-Animated", strconv.FormatBool(IsAnimatedAVIF(data)))
+	http.ServeContent(w, r, hash+"."+format, time.Time{}, bytes.NewReader(data))
 }
 
-const MAX_AVATAR_SIZE_MB = 16
-const MAX_AVATAR_SIZE = 1024 * 1024 * MAX_AVATAR_SIZE_MB
-const MAX_AVATAR_RES = 4096
+func GetDefaultAvatarEndpoint(w http.ResponseWriter, r *http.Request) {
+	// This endpoint does not require authentication
+	userId, err := uuid.Parse(r.PathValue("userId"))
+	if err != nil {
+		http.Error(w, errorJson("Invalid user ID!"), http.StatusBadRequest)
+		return
+	}
+	size, format, ok := parseAvatarQuery(w, r)
+	if !ok {
+		return
+	}
+	// Default avatars only change if the palette is reconfigured
+	etag := "\"default-" + userId.String() + "-" + strconv.Itoa(size) + "-" + format + "-" +
+		identiconPaletteTag + "\""
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := GetDefaultAvatar(userId, size, format)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, errorJson("User not found!"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleInternalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", avatarContentTypes[format])
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, userId.String()+"."+format, time.Time{}, bytes.NewReader(data))
+}
 
 func ChangeAvatarEndpoint(w http.ResponseWriter, r *http.Request) {
 	user, token := IsAuthenticatedHTTP(w, r)
@@ -97,20 +153,60 @@ func ChangeAvatarEndpoint(w http.ResponseWriter, r *http.Request) {
 	// Read the body
 	var data []byte = nil
 	var hash string = ""
+	var animation *AnimatedImage = nil
 	if r.Body != nil {
 		avatarData := new(bytes.Buffer)
-		if n, err := io.CopyN(avatarData, r.Body, MAX_AVATAR_SIZE); err != nil && !errors.Is(err, io.EOF) {
-			handleInternalServerError(w, err)
+		maxSize := int64(config.Limits.MaxAvatarSize) * 1024 * 1024
+		maxRes := config.Limits.MaxAvatarResolution
+		n, err := io.CopyN(avatarData, r.Body, maxSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			handleInternalServerError(w, r, err)
 			return
-		} else if n == MAX_AVATAR_SIZE {
+		} else if n == maxSize {
 			http.Error(w,
-				errorJson("Avatar data too large! Maximum size is "+strconv.Itoa(MAX_AVATAR_SIZE_MB)+" MB."),
+				errorJson("Avatar data too large! Maximum size is "+strconv.Itoa(config.Limits.MaxAvatarSize)+" MB."),
 				http.StatusBadRequest)
 			return
-		} else if n > 0 {
-			// Decode the image
-			originalImage, _, err := image.Decode(avatarData)
-			if err != nil {
+		} else if n > 0 && SupportsAnimation(AvatarMasterFormat()) {
+			// Decode animated GIF and WebP images, keeping every frame
+			err = runImageJob(r.Context(), func(ctx context.Context) (err error) {
+				res := min(maxRes, config.Limits.MaxAnimatedResolution)
+				animation, err = DecodeAnimation(avatarData.Bytes(), res)
+				return
+			})
+			if errors.Is(err, ErrAnimationTooLong) {
+				http.Error(w, errorJson("Animated avatar too long! Maximum is "+
+					strconv.Itoa(config.Limits.MaxAvatarFrames)+" frames and "+
+					strconv.Itoa(config.Limits.MaxAvatarDuration)+" seconds."), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, ErrImageTooLarge) {
+				http.Error(w, errorJson("Avatar image dimensions are too large!"), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				http.Error(w, errorJson("Took too long to decode avatar image!"), http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				http.Error(w, errorJson("Failed to decode animated avatar image!"), http.StatusBadRequest)
+				return
+			} else if animation != nil {
+				// Encode the animation
+				data, err = EncodeAnimation(r.Context(), animation, AvatarMasterFormat(), AVIF_QUALITY)
+				if err != nil {
+					handleInternalServerError(w, r, err)
+					return
+				}
+			}
+		}
+		if n > 0 && animation == nil {
+			// Decode the image, only keeping the first frame of animated images
+			originalImage, _, err := DecodeImage(r.Context(), avatarData.Bytes())
+			if errors.Is(err, ErrImageTooLarge) {
+				http.Error(w, errorJson("Avatar image dimensions are too large!"), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				http.Error(w, errorJson("Took too long to decode avatar image!"), http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
 				http.Error(w, errorJson("Failed to decode avatar image! Supported formats: PNG, JPEG, GIF, WebP, AVIF, BMP, TIFF"),
 					http.StatusBadRequest)
 				return
@@ -118,71 +214,78 @@ func ChangeAvatarEndpoint(w http.ResponseWriter, r *http.Request) {
 			// Crop the image
 			croppedImage := originalImage
 			if originalImage.Bounds().Dx() != originalImage.Bounds().Dy() {
-				res := min(originalImage.Bounds().Dx(), originalImage.Bounds().Dy(), MAX_AVATAR_RES)
+				res := min(originalImage.Bounds().Dx(), originalImage.Bounds().Dy(), maxRes)
 				croppedImage = imaging.Fill(originalImage, res, res, imaging.Center, imaging.Lanczos)
-			} else if originalImage.Bounds().Dx() > MAX_AVATAR_RES {
-				croppedImage = imaging.Resize(originalImage, 4096, 4096, imaging.Lanczos)
+			} else if originalImage.Bounds().Dx() > maxRes {
+				croppedImage = imaging.Resize(originalImage, maxRes, maxRes, imaging.Lanczos)
 			}
 			// Encode the image
-			data, err = EncodeAVIF(croppedImage, AVIF_QUALITY)
+			data, err = EncodeImage(r.Context(), croppedImage, AvatarMasterFormat(), AVIF_QUALITY)
 			if err != nil {
-				handleInternalServerError(w, err)
+				handleInternalServerError(w, r, err)
 				return
 			}
+		}
+		if data != nil {
 			hashBytes := sha256.Sum256(data)
 			hash = hex.EncodeToString(hashBytes[:])
 		}
 	}
 
+	// Write the avatar to the blob store if configured
+	stored := data
+	if hash != "" {
+		var err error
+		if stored, err = storeAvatarBlob(hash, avatarOriginalBlob, data); err != nil {
+			handleInternalServerError(w, r, err)
+			return
+		}
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
 	defer tx.Rollback()
 
-	// Insert new avatar (ignore if avatar already exists)
+	// Insert new avatar (or reset its age if the avatar already exists)
 	if hash != "" {
-		if _, err := tx.Stmt(insertAvatarStmt).Exec(hash, data); err != nil {
-			handleInternalServerError(w, err)
+		if _, err := tx.Stmt(insertAvatarStmt).Exec(hash, stored, animation != nil); err != nil {
+			handleInternalServerError(w, r, err)
 			return
 		}
 	}
 	// Update user avatar
 	avatarHash := sql.NullString{Valid: hash != "", String: hash}
 	if result, err := tx.Stmt(updateUserAvatarStmt).Exec(avatarHash, token.UserID); err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-		handleInternalServerError(w, err) // nil err solved by Ostrich algorithm
+		handleInternalServerError(w, r, err) // nil err solved by Ostrich algorithm
 		return
 	}
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
-	// Delete old avatar
-	if user.Avatar != nil {
-		_, err := deleteAvatarStmt.Exec(*user.Avatar)
-		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23503" {
-			// Do nothing
-		} else if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1451 {
-			// Do nothing
-		} else if err != nil {
-			handleInternalServerError(w, err)
-			return
-		}
-	}
+	// The old avatar is deleted by CollectOrphanedAvatars once it is no longer used
 
 	hashOrNil := &hash
 	if hash == "" {
 		hashOrNil = nil
+	} else {
+		PregenerateAvatarVariants(hash, animation)
 	}
 	propagateUserProfileUpdate(user.ID, struct {
 		Avatar *string `json:"avatar"`
 	}{Avatar: hashOrNil})
-	w.Write([]byte("{\"success\":true}"))
+	json.NewEncoder(w).Encode(struct {
+		Success  bool    `json:"success"`
+		Avatar   *string `json:"avatar"`
+		Animated bool    `json:"animated"`
+	}{Success: true, Avatar: hashOrNil, Animated: animation != nil})
 }
 
 func GetUserProfilesEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -205,40 +308,15 @@ func GetUserProfilesEndpoint(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var rows *sql.Rows
-	if config.Database == "mysql" {
-		placeholders := strings.Repeat("?,", len(requestedIds))
-		placeholders = placeholders[:len(placeholders)-1]
-		mysqlArr := make([]interface{}, len(requestedIds))
-		for i, id := range requestedIds {
-			mysqlArr[i] = id
-		}
-		rows, err = prepareQuery(
-			"SELECT id, username, avatar FROM users WHERE id IN (" + placeholders + ");").Query(mysqlArr...)
-	} else {
-		rows, err = findUserProfilesByIdStmt.Query(pq.Array(requestedIds))
-	}
+	profiles, err := FindUserProfiles(ids)
 	if err != nil {
-		handleInternalServerError(w, err)
+		handleInternalServerError(w, r, err)
 		return
 	}
-
-	defer rows.Close()
 	usernames := make(map[string]UserProfile)
-	for rows.Next() {
-		var id uuid.UUID
-		var userProfile UserProfile
-		if err = rows.Scan(&id, &userProfile.Username, &userProfile.Avatar); err != nil {
-			handleInternalServerError(w, err)
-			return
-		}
+	for id, userProfile := range profiles {
 		usernames[id.String()] = userProfile
 	}
-	if rows.Err() != nil {
-		handleInternalServerError(w, err)
-		return
-	}
-
 	json.NewEncoder(w).Encode(usernames)
 }
 
@@ -7,9 +7,10 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -23,6 +24,7 @@ type AuthMessageIncoming struct {
 	Token     string `json:"token"`
 	ClientID  string `json:"clientId"`
 	Reconnect bool   `json:"reconnect"` // If this is a reconnect
+	Password  string `json:"password"`  // Required to join password protected rooms as a non-member
 }
 
 type GenericMessage struct {
@@ -80,9 +82,50 @@ type ChatMessageOutgoing struct {
 	Data []ChatMessage `json:"data"`
 }
 
+type ChatDeleteMessageOutgoing struct {
+	Type string `json:"type"` // chat_delete
+	Data []int  `json:"data"`
+}
+
 type SubtitleMessageOutgoing struct {
-	Type string   `json:"type"` // subtitle
-	Data []string `json:"data"`
+	Type     string             `json:"type"` // subtitle
+	Data     []string           `json:"data"` // Names of added or updated subtitles
+	Metadata []SubtitleMetadata `json:"metadata"`
+	Removed  []string           `json:"removed,omitempty"`
+}
+
+func NewSubtitleMessage(metadata []SubtitleMetadata, removed []string) SubtitleMessageOutgoing {
+	names := make([]string, len(metadata))
+	for i, subtitle := range metadata {
+		names[i] = subtitle.Name
+	}
+	return SubtitleMessageOutgoing{Type: "subtitle", Data: names, Metadata: metadata, Removed: removed}
+}
+
+type SubtitleOffsetMessageIncoming struct {
+	Type   string  `json:"type"` // subtitle_offset
+	Name   string  `json:"name"` // Empty to set the room's offset, otherwise the subtitle's own offset
+	Offset float64 `json:"offset"`
+}
+
+type SubtitleOffsetMessageOutgoing struct {
+	Type   string    `json:"type"` // subtitle_offset
+	UserID uuid.UUID `json:"userId"`
+	Name   string    `json:"name,omitempty"`
+	Offset float64   `json:"offset"`
+}
+
+type ErrorMessageOutgoing struct {
+	Type       string  `json:"type"` // error
+	Error      string  `json:"error"`
+	RetryAfter float64 `json:"retryAfter,omitempty"` // Seconds
+}
+
+// ServerRestartMessageOutgoing is sent before the server shuts down, after which the connection is
+// closed with websocket.StatusServiceRestart.
+type ServerRestartMessageOutgoing struct {
+	Type           string  `json:"type"`           // server_restart
+	ReconnectAfter float64 `json:"reconnectAfter"` // Seconds
 }
 
 type UserProfileUpdateMessageOutgoing struct {
@@ -94,6 +137,15 @@ type UserProfileUpdateMessageOutgoing struct {
 const (
 	WsInternalAuthDisconnect = iota
 	WsInternalClientReconnect
+	WsInternalKick
+	WsInternalBan
+)
+
+// Close codes for connections removed from a room by a moderator, so clients can tell them apart
+// from other errors and avoid reconnecting.
+const (
+	WsCloseKicked websocket.StatusCode = 4410
+	WsCloseBanned websocket.StatusCode = 4411
 )
 
 func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -106,10 +158,12 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	openWebSockets.Add(1)
+	defer openWebSockets.Add(-1)
 
 	// Wait for auth message
 	var authMessage AuthMessageIncoming
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, cancel := context.WithTimeout(context.Background(), webSocketTimeout())
 	err = wsjson.Read(ctx, c, &authMessage)
 	cancel()
 	if err != nil {
@@ -121,33 +175,72 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		wsError(c, "You are not logged in! Please sign in to continue.", 4401)
 		return
 	} else if err != nil {
-		wsInternalError(c, err)
+		wsInternalError(c, r, err)
 		return
-	} else if rooms, ok := userConns.Load(user.ID); ok && rooms.Size() >= 3 {
+	}
+	setRequestUser(r.Context(), user.ID)
+	if rooms, ok := userConns.Load(user.ID); ok && rooms.Size() >= config.Limits.MaxRoomsPerUser {
 		wsError(c, "You are in too many rooms!", 4429)
 		return
 	}
 
 	// Get room details, if not exists, boohoo
-	room := Room{}
-	err = findRoomStmt.QueryRow(r.PathValue("id")).Scan(
-		&room.ID, &room.CreatedAt, &room.ModifiedAt, &room.Type, &room.Target,
-		&room.Paused, &room.Speed, &room.Timestamp, &room.LastAction)
+	room, err := FindRoom(r.PathValue("id"))
 	if errors.Is(err, sql.ErrNoRows) {
 		wsError(c, "Room not found!", 4404)
 		return
 	} else if err != nil {
-		wsInternalError(c, err)
+		wsInternalError(c, r, err)
+		return
+	}
+	if ban, err := FindRoomBan(room.ID, user.ID); err == nil && !room.IsModerator(user.ID) {
+		wsError(c, ban.Message(), WsCloseBanned)
+		return
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		wsInternalError(c, r, err)
 		return
 	}
+	if ok, err := CanAccessRoom(&room, user.ID); err != nil {
+		wsInternalError(c, r, err)
+		return
+	} else if !ok && room.Visibility == RoomVisibilityPrivate {
+		wsError(c, "This room is private! You need an invite to join it.", 4403)
+		return
+	} else if !ok && authMessage.Password == "" {
+		wsError(c, "This room is password protected!", 4403)
+		return
+	} else if !ok {
+		if allowed, _ := GetUserRateLimits(user.ID).RoomPassword.Take(); !allowed {
+			wsError(c, "Too many incorrect password attempts! Please try again later.", 4429)
+			return
+		} else if !ComparePassword(authMessage.Password, *room.Password) {
+			wsError(c, "Incorrect room password!", 4403)
+			return
+		}
+	}
+	if _, err = upsertRoomMemberStmt.Exec(room.ID, user.ID); err != nil {
+		wsInternalError(c, r, err)
+		return
+	}
+	if room.ArchivedAt != nil { // Reactivate archived rooms
+		if _, err = unarchiveRoomStmt.Exec(room.ID); err != nil {
+			wsInternalError(c, r, err)
+			return
+		}
+		room.ArchivedAt = nil
+	}
 	chat, err := FindChatMessagesByRoom(room.ID)
 	if err != nil {
-		wsInternalError(c, err)
+		wsInternalError(c, r, err)
 		return
 	}
 	subtitle, err := FindSubtitlesByRoom(room.ID)
 	if err != nil {
-		wsInternalError(c, err)
+		wsInternalError(c, r, err)
+		return
+	}
+	if err = LoadRoomMutes(room.ID); err != nil {
+		wsInternalError(c, r, err)
 		return
 	}
 
@@ -186,13 +279,43 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	err = wsjsonWriteWithTimeout(context.Background(), c,
-		SubtitleMessageOutgoing{Type: "subtitle", Data: subtitle})
+		NewSubtitleMessage(subtitle, nil))
 	if err != nil {
 		wsError(c, "Failed to write data!", websocket.StatusProtocolError)
 		return
 	}
+	err = wsjsonWriteWithTimeout(context.Background(), c,
+		SubtitleOffsetMessageOutgoing{Type: "subtitle_offset", Offset: room.SubtitleOffset})
+	if err != nil {
+		wsError(c, "Failed to write data!", websocket.StatusProtocolError)
+		return
+	}
+	if job, ok := subtitleExtractionJobs.Load(room.ID); ok {
+		err = wsjsonWriteWithTimeout(context.Background(), c,
+			SubtitleExtractionMessageOutgoing{Type: "subtitle_extraction", Data: job})
+		if err != nil {
+			wsError(c, "Failed to write data!", websocket.StatusProtocolError)
+			return
+		}
+	}
+	if nicknames, ok := roomNicknames.Load(room.ID); ok {
+		nicknames.Range(func(userId uuid.UUID, nickname string) bool {
+			err = wsjsonWriteWithTimeout(context.Background(), c, UserProfileUpdateMessageOutgoing{
+				Type: "user_profile_update",
+				ID:   userId,
+				Data: struct {
+					Nickname string `json:"nickname"`
+				}{Nickname: nickname},
+			})
+			return err == nil
+		})
+		if err != nil {
+			wsError(c, "Failed to write data!", websocket.StatusProtocolError)
+			return
+		}
+	}
 
-	writeChannel := make(chan interface{}, 16)
+	writeChannel := make(chan interface{}, config.Limits.WriteChannelSize)
 	defer close(writeChannel)
 	// Register user to room
 	clientId := authMessage.ClientID
@@ -203,11 +326,26 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 	members, previousConnectionExisted :=
 		RegisterConnection(room.ID, connId, authMessage.Token, writeChannel)
 	defer UnregisterConnection(room.ID, connId, members, writeChannel)
+	roomSlowModes.Store(room.ID, time.Duration(room.SlowMode)*time.Second)
 
 	// Create write thread
 	var silentlyDisconnect atomic.Bool
 	go (func() {
-		for msg := range writeChannel {
+		for {
+			var msg interface{}
+			var ok bool
+			select {
+			case msg, ok = <-writeChannel:
+			case <-serverRestart:
+				silentlyDisconnect.Store(true) // Everyone is disconnected, and will reconnect shortly.
+				_ = wsjsonWriteWithTimeout(context.Background(), c, ServerRestartMessageOutgoing{
+					Type: "server_restart", ReconnectAfter: reconnectDelay().Seconds()})
+				_ = c.Close(websocket.StatusServiceRestart, "The server is restarting!")
+				return
+			}
+			if !ok {
+				return
+			}
 			switch msg {
 			case WsInternalAuthDisconnect:
 				wsError(c, "You are not logged in! Please sign in to continue.", 4401)
@@ -216,6 +354,14 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 				silentlyDisconnect.Store(true) // Don't notify other clients of a disconnect.
 				wsError(c, "You reconnected from the same client instance!", 4401)
 				return
+			case WsInternalKick:
+				silentlyDisconnect.Store(true) // The kick is announced by whoever issued it.
+				wsError(c, "You were kicked from the room!", WsCloseKicked)
+				return
+			case WsInternalBan:
+				silentlyDisconnect.Store(true) // The ban is announced by whoever issued it.
+				wsError(c, "You were banned from the room!", WsCloseBanned)
+				return
 			}
 			err := wsjsonWriteWithTimeout(context.Background(), c, msg)
 			if errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled) { // TODO correct?
@@ -230,27 +376,39 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 	// Send chat message: user joined/reconnected
 	// If not a reconnect, OR reconnect + no previous connection
 	if !authMessage.Reconnect || (!previousConnectionExisted && authMessage.Reconnect) {
-		chatMsg := ChatMessage{UserID: uuid.Nil}
+		msg := "joined"
 		if authMessage.Reconnect {
-			chatMsg.Message = user.ID.String() + " reconnected"
-		} else {
-			chatMsg.Message = user.ID.String() + " joined"
+			msg = "reconnected"
 		}
-		chatMsg.ID, chatMsg.Timestamp, err = InsertChatMessage(room.ID, nil, chatMsg.Message)
-		if err != nil {
-			wsInternalError(c, err)
+		if err = BroadcastSystemMessage(room.ID, user.ID, msg); err != nil {
+			wsInternalError(c, r, err)
 			return
 		}
-		members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
-			write <- ChatMessageOutgoing{Type: "chat", Data: []ChatMessage{chatMsg}}
-			return true
-		})
+	}
+
+	commandCtx := &ChatCommandContext{
+		Room:         &room,
+		User:         user,
+		Members:      members,
+		WriteChannel: writeChannel,
 	}
 
 	// Read all messages
 	var closeStatus websocket.StatusCode = -1
+	rateLimits := GetUserRateLimits(user.ID)
+	abuseLimiter := NewAbuseLimiter()
+	// Notify the client of a dropped message, or disconnect them if they keep hitting rate limits.
+	rateLimited := func(msg string, retryAfter time.Duration) (disconnect bool) {
+		if ok, _ := abuseLimiter.Take(); !ok {
+			closeStatus = websocket.StatusPolicyViolation
+			wsError(c, "You are sending messages too quickly!", closeStatus)
+			return true
+		}
+		writeChannel <- ErrorMessageOutgoing{Type: "error", Error: msg, RetryAfter: retryAfter.Seconds()}
+		return false
+	}
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		ctx, cancel := context.WithTimeout(context.Background(), webSocketTimeout())
 		_, data, err := c.Read(ctx)
 		cancel()
 		closeStatus = websocket.CloseStatus(err)
@@ -268,32 +426,95 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		// Parse message
 		var msgData GenericMessage
 		err = json.Unmarshal(data, &msgData)
+		CountWebSocketMessage(msgData.Type)
 		if err != nil {
 			wsError(c, "Invalid message!", websocket.StatusUnsupportedData)
 		} else if msgData.Type == "chat" {
+			// Chat commands count towards the rate limit too
+			if ok, retryAfter := rateLimits.Chat.Take(); !ok {
+				if rateLimited("You are sending messages too quickly!", retryAfter) {
+					break
+				}
+				continue
+			}
 			var chatData ChatMessageIncoming
 			err = json.Unmarshal(data, &chatData)
-			// Enforce 2000 char chat message limit
+			// Enforce chat message length limit
 			msg := strings.TrimSpace(chatData.Data)
 			if err != nil {
 				wsError(c, "Invalid chat message!", websocket.StatusUnsupportedData)
 				continue
-			} else if len(msg) > 2000 || len(msg) == 0 {
-				continue // Discard invalid length messages silently
+			} else if len(msg) > config.Limits.MaxChatMessageLength || len(msg) == 0 {
+				writeChannel <- ErrorMessageOutgoing{
+					Type: "error",
+					Error: "Chat messages must be between 1 and " +
+						strconv.Itoa(config.Limits.MaxChatMessageLength) + " characters long!",
+				}
+				continue
+			} else if expiresAt := GetMuteExpiry(room.ID, user.ID); !expiresAt.IsZero() {
+				writeChannel <- ErrorMessageOutgoing{
+					Type:       "error",
+					Error:      "You are muted in this room!",
+					RetryAfter: time.Until(expiresAt).Seconds(),
+				}
+				continue
+			} else if IsChatCommand(msg) {
+				if err = HandleChatCommand(commandCtx, msg); err != nil {
+					wsInternalError(c, r, err)
+					return
+				}
+				continue
+			}
+			msg = strings.TrimPrefix(msg, "/") // Unescape messages starting with //
+			if !room.IsModerator(user.ID) {
+				if wait := CheckSlowMode(room.ID, user.ID); wait > 0 {
+					writeChannel <- ErrorMessageOutgoing{
+						Type:       "error",
+						Error:      "Slow mode is enabled in this room! Please wait before sending another message.",
+						RetryAfter: wait.Seconds(),
+					}
+					continue
+				}
+			}
+
+			msg, rejected, flagged, err := FilterChatMessage(room.ID, msg)
+			if err != nil {
+				wsInternalError(c, r, err)
+				return
+			} else if rejected {
+				writeChannel <- ErrorMessageOutgoing{
+					Type:  "error",
+					Error: "Your message was blocked by this room's chat filter!",
+				}
+				continue
 			}
 
 			// Update state in db and broadcast
 			chatMsg := ChatMessage{UserID: user.ID, Message: msg}
 			chatMsg.ID, chatMsg.Timestamp, err = InsertChatMessage(room.ID, &user.ID, chatMsg.Message)
 			if err != nil {
-				wsInternalError(c, err)
+				wsInternalError(c, r, err)
 				return
 			}
+			if len(flagged) > 0 {
+				err = InsertModerationLog(room.ID, nil, &user.ID, "flag", "Message #"+
+					strconv.Itoa(chatMsg.ID)+" matched filters: "+strings.Join(flagged, ", "))
+				if err != nil {
+					wsInternalError(c, r, err)
+					return
+				}
+			}
 			members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
 				write <- ChatMessageOutgoing{Type: "chat", Data: []ChatMessage{chatMsg}}
 				return true
 			})
 		} else if msgData.Type == "player_state" {
+			if ok, retryAfter := rateLimits.PlayerState.Take(); !ok {
+				if rateLimited("You are changing the player state too quickly!", retryAfter) {
+					break
+				}
+				continue
+			}
 			var playerStateData PlayerStateMessageBi
 			err = json.Unmarshal(data, &playerStateData)
 			if err != nil {
@@ -302,31 +523,72 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Update state in db and broadcast
+			if err = UpdateRoomState(room.ID, playerStateData.Data); err != nil {
+				wsInternalError(c, r, err)
+				return
+			}
+			members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+				if write != writeChannel { // Skip current session
+					write <- playerStateData
+				}
+				return true
+			})
+		} else if msgData.Type == "subtitle_offset" {
+			if ok, retryAfter := rateLimits.PlayerState.Take(); !ok {
+				if rateLimited("You are changing the subtitle offset too quickly!", retryAfter) {
+					break
+				}
+				continue
+			}
+			var offsetData SubtitleOffsetMessageIncoming
+			err = json.Unmarshal(data, &offsetData)
+			if err != nil {
+				wsError(c, "Invalid subtitle offset message!", websocket.StatusUnsupportedData)
+				continue
+			} else if !(offsetData.Offset >= -3600 && offsetData.Offset <= 3600) {
+				writeChannel <- ErrorMessageOutgoing{
+					Type:  "error",
+					Error: "Subtitle offsets must be between -3600 and 3600 seconds!",
+				}
+				continue
+			}
+
+			// Update offset in db and broadcast
 			var result sql.Result
-			if config.Database == "mysql" {
-				result, err = updateRoomStateStmt.Exec(
-					playerStateData.Data.Paused, playerStateData.Data.Speed,
-					playerStateData.Data.Timestamp, playerStateData.Data.LastAction,
-					room.ID)
+			if offsetData.Name == "" {
+				result, err = updateRoomSubtitleOffsetStmt.Exec(offsetData.Offset, room.ID)
 			} else {
-				result, err = updateRoomStateStmt.Exec(room.ID,
-					playerStateData.Data.Paused, playerStateData.Data.Speed,
-					playerStateData.Data.Timestamp, playerStateData.Data.LastAction)
+				result, err = updateSubtitleOffsetStmt.Exec(offsetData.Offset, room.ID, offsetData.Name)
 			}
 			if err != nil {
-				wsInternalError(c, err)
+				wsInternalError(c, r, err)
 				return
-			} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-				wsInternalError(c, err)
+			} else if rows, err := result.RowsAffected(); err != nil {
+				wsInternalError(c, r, err)
 				return
+			} else if rows != 1 {
+				writeChannel <- ErrorMessageOutgoing{Type: "error", Error: "Subtitle not found!"}
+				continue
 			}
 			members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
-				if write != writeChannel { // Skip current session
-					write <- playerStateData
+				write <- SubtitleOffsetMessageOutgoing{
+					Type:   "subtitle_offset",
+					UserID: user.ID,
+					Name:   offsetData.Name,
+					Offset: offsetData.Offset,
 				}
 				return true
 			})
 		} else if msgData.Type == "typing" {
+			if ok, retryAfter := rateLimits.Typing.Take(); !ok {
+				if rateLimited("You are sending typing indicators too quickly!", retryAfter) {
+					break
+				}
+				continue
+			}
+			if !GetMuteExpiry(room.ID, user.ID).IsZero() {
+				continue // Muted users cannot chat, so they cannot be typing either
+			}
 			var incoming TypingIndicatorMessageIncoming
 			err = json.Unmarshal(data, &incoming)
 			if err != nil {
@@ -339,8 +601,8 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 				Timestamp: incoming.Timestamp,
 			}
 			members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
-				if write != writeChannel { // Skip current session
-					write <- outgoingData
+				if write != writeChannel { // Skip current session, typing indicators can be dropped
+					trySend(write, "typing", outgoingData)
 				}
 				return true
 			})
@@ -357,29 +619,27 @@ func JoinRoomEndpoint(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Notify other clients of the disconnect
-	if silentlyDisconnect.Load() {
+	slog.InfoContext(r.Context(), "WebSocket closed", "room_id", room.ID, "close_status", int(closeStatus))
+
+	// Notify other clients of the disconnect, unless they are about to be disconnected too
+	if silentlyDisconnect.Load() || IsShuttingDown() {
 		return
 	}
-	chatMsg := ChatMessage{UserID: uuid.Nil}
+	msg := "was disconnected"
 	if closeStatus == websocket.StatusNormalClosure || closeStatus == websocket.StatusGoingAway {
-		chatMsg.Message = user.ID.String() + " left"
-	} else {
-		chatMsg.Message = user.ID.String() + " was disconnected"
+		msg = "left"
 	}
-	chatMsg.ID, chatMsg.Timestamp, err = InsertChatMessage(room.ID, nil, chatMsg.Message)
-	if err != nil {
-		log.Println("Internal Server Error!", err)
-		return
+	if err = BroadcastSystemMessage(room.ID, user.ID, msg); err != nil {
+		slog.ErrorContext(r.Context(), "Internal Server Error!", "error", err)
 	}
-	members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
-		write <- ChatMessageOutgoing{Type: "chat", Data: []ChatMessage{chatMsg}}
-		return true
-	})
+}
+
+func webSocketTimeout() time.Duration {
+	return time.Duration(config.Limits.WebSocketTimeout) * time.Second
 }
 
 func wsjsonWriteWithTimeout(ctx context.Context, c *websocket.Conn, v interface{}) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctx, cancel := context.WithTimeout(ctx, webSocketTimeout())
 	defer cancel()
 	return wsjson.Write(ctx, c, v)
 }
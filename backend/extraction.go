@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// EmbeddedSubtitle is a subtitle stream muxed into a media file, as reported by ffprobe.
+type EmbeddedSubtitle struct {
+	Index       int    `json:"index"`
+	Codec       string `json:"codec"`
+	Language    string `json:"language"`
+	Title       string `json:"title"`
+	Default     bool   `json:"default"`
+	Forced      bool   `json:"forced"`
+	SDH         bool   `json:"sdh"`
+	Extractable bool   `json:"extractable"` // Image-based subtitles cannot be converted to WebVTT
+}
+
+// Image-based subtitle codecs, which would require OCR to convert to text
+var bitmapSubtitleCodecs = []string{"hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle", "xsub"}
+
+const (
+	SubtitleExtractionRunning = "running"
+	SubtitleExtractionDone    = "done"
+	SubtitleExtractionFailed  = "failed"
+)
+
+type SubtitleExtractionJob struct {
+	ID        string    `json:"id"`
+	UserID    uuid.UUID `json:"userId"`
+	Streams   []int     `json:"streams"`
+	Status    string    `json:"status"`
+	Progress  float64   `json:"progress"` // 0 to 1
+	Error     string    `json:"error,omitempty"`
+	Extracted []string  `json:"extracted,omitempty"` // Names of the saved subtitles
+	StartedAt time.Time `json:"startedAt"`
+}
+
+type SubtitleExtractionMessageOutgoing struct {
+	Type string                `json:"type"` // subtitle_extraction
+	Data SubtitleExtractionJob `json:"data"`
+}
+
+// Jobs are stored by value and replaced on every update, so they can be read from any goroutine.
+var subtitleExtractionJobs *xsync.MapOf[string, SubtitleExtractionJob] = xsync.NewMapOf[string, SubtitleExtractionJob]()
+
+// Extraction reads through the entire media file, so only a few jobs should run at once.
+var subtitleExtractionSemaphore = make(chan struct{}, 2)
+
+const subtitleProbeTimeout = 30 * time.Second
+const subtitleExtractionTimeout = 30 * time.Minute
+
+// ffmpeg supports many protocols which can read local files, so only allow these. Connections are
+// made through the media proxy, see media_proxy.go.
+const ffmpegProtocolWhitelist = "http,https,tcp,tls,httpproxy"
+
+// MediaURLFromTarget returns the URL of a remote_file room's media, if it can be read by ffmpeg.
+func MediaURLFromTarget(roomType string, target string) (string, bool) {
+	if roomType != "remote_file" {
+		return "", false
+	}
+	mediaUrl, err := url.Parse(target)
+	if err != nil || (mediaUrl.Scheme != "http" && mediaUrl.Scheme != "https") || mediaUrl.Host == "" {
+		return "", false
+	}
+	return mediaUrl.String(), true
+}
+
+// IsFFmpegAvailable returns whether both ffprobe and ffmpeg can be found on the PATH.
+func IsFFmpegAvailable() bool {
+	_, ffprobeErr := exec.LookPath("ffprobe")
+	_, ffmpegErr := exec.LookPath("ffmpeg")
+	return ffprobeErr == nil && ffmpegErr == nil
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		Index       int               `json:"index"`
+		CodecName   string            `json:"codec_name"`
+		Tags        map[string]string `json:"tags"`
+		Disposition map[string]int    `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// ProbeSubtitleStreams lists the subtitle streams in a media file along with its duration.
+func ProbeSubtitleStreams(ctx context.Context, mediaUrl string) ([]EmbeddedSubtitle, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, subtitleProbeTimeout)
+	defer cancel()
+	proxyUrl, err := MediaProxyURL()
+	if err != nil {
+		return nil, 0, err
+	}
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-protocol_whitelist", ffmpegProtocolWhitelist,
+		"-http_proxy", proxyUrl, "-select_streams", "s", "-show_entries", "stream=index,codec_name:stream_tags:stream_disposition"+
+			":format=duration", "-of", "json", mediaUrl)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		slog.ErrorContext(ctx, "ffprobe error", "error", err, "output", stderr.String())
+		return nil, 0, err
+	}
+	var output ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, 0, err
+	}
+	streams := make([]EmbeddedSubtitle, len(output.Streams))
+	for i, stream := range output.Streams {
+		streams[i] = EmbeddedSubtitle{
+			Index:       stream.Index,
+			Codec:       stream.CodecName,
+			Language:    stream.Tags["language"],
+			Title:       stream.Tags["title"],
+			Default:     stream.Disposition["default"] == 1,
+			Forced:      stream.Disposition["forced"] == 1,
+			SDH:         stream.Disposition["hearing_impaired"] == 1,
+			Extractable: !slices.Contains(bitmapSubtitleCodecs, stream.CodecName),
+		}
+	}
+	duration, _ := strconv.ParseFloat(output.Format.Duration, 64)
+	return streams, time.Duration(duration * float64(time.Second)), nil
+}
+
+// ExtractSubtitleStreams converts the given subtitle streams of a media file to WebVTT in a single
+// pass with ffmpeg, reporting progress (0 to 1) as the file is read.
+func ExtractSubtitleStreams(
+	ctx context.Context, mediaUrl string, streams []int, duration time.Duration, progress func(float64),
+) (map[int]string, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "concinnity-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	proxyUrl, err := MediaProxyURL()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-nostdin", "-v", "error", "-protocol_whitelist", ffmpegProtocolWhitelist,
+		"-progress", "pipe:1", "-http_proxy", proxyUrl, "-i", mediaUrl}
+	for _, index := range streams {
+		args = append(args, "-map", "0:"+strconv.Itoa(index), "-c:s", "webvtt",
+			filepath.Join(dir, strconv.Itoa(index)+".vtt"))
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// ffmpeg periodically writes key=value lines, including the position it has read up to
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if key == "out_time_us" && duration > 0 {
+			if position, err := strconv.ParseInt(value, 10, 64); err == nil {
+				progress(min(1, max(0, float64(position)*float64(time.Microsecond)/float64(duration))))
+			}
+		}
+	}
+	if err = cmd.Wait(); err != nil {
+		slog.ErrorContext(ctx, "ffmpeg error", "error", err, "output", stderr.String())
+		return nil, err
+	}
+
+	subtitles := make(map[int]string)
+	for _, index := range streams {
+		path := filepath.Join(dir, strconv.Itoa(index)+".vtt")
+		if info, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if info.Size() > int64(config.Limits.MaxSubtitleSize)*1024 { // Same limit as uploads
+			return nil, errors.New("extracted subtitle stream " + strconv.Itoa(index) + " is too large")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		subtitles[index] = string(data)
+	}
+	return subtitles, nil
+}
+
+// embeddedSubtitleName returns a name for an extracted subtitle, based on its title and language.
+func embeddedSubtitleName(stream EmbeddedSubtitle) string {
+	name := stream.Title
+	if name == "" {
+		name = "Track " + strconv.Itoa(stream.Index)
+	}
+	if stream.Language != "" && stream.Language != "und" {
+		name += " (" + stream.Language + ")"
+	}
+	if len(name) > 200 {
+		name = strings.ToValidUTF8(name[:200], "")
+	}
+	return name
+}
+
+// StartSubtitleExtraction starts a background job extracting embedded subtitles from a room's
+// media and saving them, unless the room already has a job running.
+func StartSubtitleExtraction(
+	roomId string, user *User, mediaUrl string, streams []EmbeddedSubtitle, duration time.Duration,
+) (SubtitleExtractionJob, bool) {
+	job := SubtitleExtractionJob{
+		ID:        uuid.NewString(),
+		UserID:    user.ID,
+		Status:    SubtitleExtractionRunning,
+		StartedAt: time.Now(),
+	}
+	for _, stream := range streams {
+		job.Streams = append(job.Streams, stream.Index)
+	}
+	current, _ := subtitleExtractionJobs.Compute(roomId,
+		func(existing SubtitleExtractionJob, loaded bool) (SubtitleExtractionJob, bool) {
+			if loaded && existing.Status == SubtitleExtractionRunning {
+				return existing, false
+			}
+			return job, false
+		})
+	if current.ID != job.ID {
+		return current, false
+	}
+
+	go (func(job SubtitleExtractionJob) {
+		update := func(update func(job *SubtitleExtractionJob)) {
+			update(&job)
+			subtitleExtractionJobs.Store(roomId, job)
+			broadcastSubtitleExtractionJob(roomId, job)
+		}
+		fail := func(err error) {
+			slog.Error("Failed to extract subtitles!", "room_id", roomId, "error", err)
+			update(func(job *SubtitleExtractionJob) {
+				job.Status = SubtitleExtractionFailed
+				job.Error = "Failed to extract subtitles from the media!"
+			})
+		}
+
+		broadcastSubtitleExtractionJob(roomId, job)
+		subtitleExtractionSemaphore <- struct{}{}
+		defer func() { <-subtitleExtractionSemaphore }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), subtitleExtractionTimeout)
+		defer cancel()
+		lastProgress := time.Time{}
+		extracted, err := ExtractSubtitleStreams(ctx, mediaUrl, job.Streams, duration, func(progress float64) {
+			if time.Since(lastProgress) >= time.Second { // Don't flood clients with updates
+				lastProgress = time.Now()
+				update(func(job *SubtitleExtractionJob) { job.Progress = progress })
+			}
+		})
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		saved := make([]SubtitleMetadata, 0, len(streams))
+		for _, stream := range streams {
+			subtitle, errs := ParseSubtitle(extracted[stream.Index])
+			if len(errs) > 0 {
+				fail(errors.New("invalid subtitle stream " + strconv.Itoa(stream.Index) + ": " + errs[0].Message))
+				return
+			}
+			metadata := SubtitleMetadata{
+				Name:       embeddedSubtitleName(stream),
+				Language:   stream.Language,
+				Label:      stream.Title,
+				UploaderID: &user.ID,
+				CueCount:   len(subtitle.Cues),
+				Forced:     stream.Forced,
+				SDH:        stream.SDH,
+			}
+			if metadata.Language == "und" || !languageTagRegex.MatchString(metadata.Language) {
+				metadata.Language = ""
+			}
+			if len(metadata.Label) > 200 {
+				metadata.Label = metadata.Name
+			}
+			vtt := subtitle.WebVTT()
+			if err = UpsertSubtitle(roomId, &metadata, vtt, vtt, SubtitleFormatWebVTT); err != nil {
+				fail(err)
+				return
+			}
+			saved = append(saved, metadata)
+		}
+		broadcastSubtitleMessage(roomId, NewSubtitleMessage(saved, nil))
+		update(func(job *SubtitleExtractionJob) {
+			job.Status = SubtitleExtractionDone
+			job.Progress = 1
+			for _, metadata := range saved {
+				job.Extracted = append(job.Extracted, metadata.Name)
+			}
+		})
+	})(job)
+	return job, true
+}
+
+// broadcastSubtitleExtractionJob never blocks, since the job holds a slot of the extraction
+// semaphore. Clients which miss an update can get the job from GET /subtitle/embedded.
+func broadcastSubtitleExtractionJob(roomId string, job SubtitleExtractionJob) {
+	if members, ok := roomMembers.Load(roomId); ok {
+		members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+			trySend(write, "subtitle_extraction",
+				SubtitleExtractionMessageOutgoing{Type: "subtitle_extraction", Data: job})
+			return true
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// /healthz reports whether the process is alive, and /readyz whether it can serve requests, for
+// container orchestrators and load balancers. Unlike GET /, neither requires authentication.
+
+const readinessCheckTimeout = 2 * time.Second
+
+const (
+	ComponentOK            = "ok"
+	ComponentFailing       = "failing"
+	ComponentDisabled      = "disabled"       // Not used with the current config
+	ComponentNotConfigured = "not_configured" // Optional features which are not configured
+)
+
+type ComponentStatus struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"` // Never raw errors, which are logged instead
+	Critical bool   `json:"critical"`        // If failing makes the server unready
+}
+
+type HealthStatus struct {
+	Status     string                     `json:"status"` // ok or failing
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+func HealthzEndpoint(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(HealthStatus{Status: ComponentOK})
+}
+
+func ReadyzEndpoint(w http.ResponseWriter, r *http.Request) {
+	components := map[string]ComponentStatus{
+		"server":   checkComponent(r.Context(), "server", true, checkNotShuttingDown()),
+		"database": checkComponent(r.Context(), "database", true, checkDatabase(r.Context())),
+	}
+	if sqlStatementsPrepared.Load() {
+		components["statements"] = ComponentStatus{Status: ComponentOK, Critical: true}
+	} else {
+		components["statements"] = ComponentStatus{
+			Status: ComponentFailing, Error: "SQL statements are not prepared", Critical: true}
+	}
+	if config.ImagePipeline == ImagePipelineLibavif {
+		_, err := exec.LookPath("avifenc")
+		components["avifenc"] = checkComponent(r.Context(), "avifenc", true, err)
+	} else {
+		components["avifenc"] = ComponentStatus{Status: ComponentDisabled}
+	}
+	if IsEmailConfigured() && config.FrontendURL != "" {
+		components["email"] = ComponentStatus{Status: ComponentOK}
+	} else {
+		components["email"] = ComponentStatus{Status: ComponentNotConfigured}
+	}
+
+	status := HealthStatus{Status: ComponentOK, Components: components}
+	for _, component := range components {
+		if component.Critical && component.Status == ComponentFailing {
+			status.Status = ComponentFailing
+		}
+	}
+	if status.Status != ComponentOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// checkComponent logs why a component is failing instead of returning it, since /readyz is public
+// and errors can reveal details about the server, such as database addresses.
+func checkComponent(ctx context.Context, name string, critical bool, err error) ComponentStatus {
+	if err != nil {
+		slog.WarnContext(ctx, "Readiness check failed!", "component", name, "error", err)
+		return ComponentStatus{Status: ComponentFailing, Critical: critical}
+	}
+	return ComponentStatus{Status: ComponentOK, Critical: critical}
+}
+
+// checkNotShuttingDown fails readiness once a graceful shutdown begins, so no new traffic is routed
+// to the server while it drains.
+func checkNotShuttingDown() error {
+	if IsShuttingDown() {
+		return errors.New("the server is shutting down")
+	}
+	return nil
+}
+
+func checkDatabase(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
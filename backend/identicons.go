@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/google/uuid"
+)
+
+// Users without an avatar get a default avatar, which is an identicon generated from their ID: a
+// symmetric 5x5 grid of cells in a colour picked from the configured palette. Unlike uploaded
+// avatars, these are cheap to generate, so they are only cached in memory.
+
+// Default avatars are drawn at this resolution, then downscaled like uploaded avatars.
+const identiconResolution = 480
+
+var identiconPalette []color.NRGBA
+
+// identiconPaletteTag identifies the configured palette in ETags, since changing it changes every
+// default avatar.
+var identiconPaletteTag string
+
+// InitIdenticonPalette parses the default avatar palette configured as hex colours.
+func InitIdenticonPalette() error {
+	if len(config.DefaultAvatarPalette) == 0 {
+		return errors.New("defaultAvatarPalette must contain at least 1 colour")
+	}
+	identiconPalette = make([]color.NRGBA, len(config.DefaultAvatarPalette))
+	for i, hexColour := range config.DefaultAvatarPalette {
+		rgb, err := hex.DecodeString(strings.TrimPrefix(hexColour, "#"))
+		if err != nil || len(rgb) != 3 {
+			return errors.New("invalid colour " + hexColour + " in defaultAvatarPalette, expected #rrggbb")
+		}
+		identiconPalette[i] = color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255}
+	}
+	paletteHash := sha256.Sum256([]byte(strings.ToLower(strings.Join(config.DefaultAvatarPalette, ","))))
+	identiconPaletteTag = hex.EncodeToString(paletteHash[:4])
+	return nil
+}
+
+// GenerateIdenticon draws the identicon of a user at identiconResolution.
+func GenerateIdenticon(userId uuid.UUID) *image.NRGBA {
+	hash := sha256.Sum256(userId[:])
+	foreground := identiconPalette[int(hash[0])%len(identiconPalette)]
+	// The background is a light tint of the foreground colour
+	background := color.NRGBA{
+		R: 255 - (255-foreground.R)/8, G: 255 - (255-foreground.G)/8, B: 255 - (255-foreground.B)/8, A: 255}
+
+	img := imaging.New(identiconResolution, identiconResolution, background)
+	cell := identiconResolution / 6 // 5 cells with half a cell of margin on each side
+	margin := (identiconResolution - cell*5) / 2
+	for row := range 5 {
+		for column := range 3 { // The right two columns mirror the left two
+			bit := row*3 + column
+			if hash[1+bit/8]&(1<<(bit%8)) == 0 {
+				continue
+			}
+			for _, x := range []int{column, 4 - column} {
+				rect := image.Rect(margin+x*cell, margin+row*cell, margin+(x+1)*cell, margin+(row+1)*cell)
+				draw.Draw(img, rect, &image.Uniform{foreground}, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// GetDefaultAvatar returns the default avatar of a user downscaled to the given size (or at its
+// original size if 0) in the given format. If the user does not exist, sql.ErrNoRows is returned.
+func GetDefaultAvatar(userId uuid.UUID, size int, format string) ([]byte, error) {
+	key := "default/" + userId.String() + "/" + strconv.Itoa(size) + "." + format
+	data, _, err := getCachedAvatar(key, func() ([]byte, bool, error) {
+		profiles, err := FindUserProfiles([]uuid.UUID{userId})
+		if err != nil {
+			return nil, false, err
+		} else if _, ok := profiles[userId]; !ok {
+			return nil, false, sql.ErrNoRows
+		}
+
+		img := GenerateIdenticon(userId)
+		if size > 0 && size < identiconResolution {
+			img = imaging.Resize(img, size, size, imaging.Lanczos)
+		}
+		var data []byte
+		if size == 0 {
+			data, err = EncodeImage(context.Background(), img, format, 100)
+		} else {
+			data, err = EncodeImage(context.Background(), img, format, AVIF_QUALITY)
+		}
+		return data, err == nil, err
+	})
+	return data, err
+}
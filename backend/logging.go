@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// InitLogger sets up the default slog logger in the configured format. The standard log package
+// writes through it as well.
+func InitLogger() {
+	var handler slog.Handler
+	if config.LogFormat == LogFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(requestContextHandler{handler}))
+}
+
+// fatal logs an error and exits, replacing log.Fatalln.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestInfo is stored in the context of every HTTP request, so logs can be attributed to it.
+type requestInfo struct {
+	ID     string
+	UserID uuid.UUID // Set once the request is authenticated
+}
+
+type requestInfoKey struct{}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// RequestID returns the ID of the request a context belongs to, or an empty string.
+func RequestID(ctx context.Context) string {
+	if info := getRequestInfo(ctx); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// setRequestUser attributes a request to the user it was authenticated as.
+func setRequestUser(ctx context.Context, userId uuid.UUID) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.UserID = userId
+	}
+}
+
+// requestContextHandler adds the request ID and user ID to records logged with a request context.
+type requestContextHandler struct {
+	slog.Handler
+}
+
+func (h requestContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := getRequestInfo(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.ID))
+		if info.UserID != uuid.Nil {
+			record.AddAttrs(slog.String("user_id", info.UserID.String()))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestContextHandler) WithGroup(name string) slog.Handler {
+	return requestContextHandler{h.Handler.WithGroup(name)}
+}
+
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap allows http.ResponseController and WebSockets to hijack and flush the response.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isValidRequestID checks that a request ID from a client is safe to log and send back.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, char := range id {
+		if char < '!' || char > '~' { // Printable ASCII without spaces
+			return false
+		}
+	}
+	return true
+}
+
+// RequestLogger assigns every request an ID, which is taken from the X-Request-ID header if a proxy
+// set one, and logs every request once it has completed. WebSocket requests complete when the
+// connection is closed.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !isValidRequestID(id) {
+			idBytes := make([]byte, 8)
+			rand.Read(idBytes)
+			id = hex.EncodeToString(idBytes)
+		}
+		info := &requestInfo{ID: id}
+		w.Header().Set("X-Request-ID", id)
+		recorder := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		observeHTTPRequest(r, recorder.status, time.Since(start))
+		level := slog.LevelInfo
+		if r.Pattern == "GET /healthz" || r.Pattern == "GET /readyz" {
+			level = slog.LevelDebug // Probed every few seconds by orchestrators
+		}
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "HTTP request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("duration", time.Since(start)))
+	})
+}
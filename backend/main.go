@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
 	"slices"
 	"strconv"
+	"syscall"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/handlers"
@@ -19,6 +25,9 @@ const version = "1.1.1"
 /*
 Endpoints:
 - GET /
+- GET /healthz - Check that the server is alive
+- GET /readyz - Check that the server is ready to serve requests, returning 503 with the status of
+  each component if not, or while it is shutting down (errors are logged rather than returned)
 - POST /api/login
 - POST /api/logout
 - POST /api/register
@@ -31,20 +40,102 @@ Endpoints:
 - DELETE /api/delete-account
 - GET /api/profiles?id=:id - Get profiles by ID, can accept multiple `id` query parameters
 - POST /api/avatar
-- GET /api/avatar/:id
-- POST /api/room - Create a new room
+- GET /api/avatar/:id - Get an avatar, accepts `size` (256 or 4096) and `format` (avif, webp, png or
+  jpeg, negotiated with the `Accept` header if omitted) query parameters. Animated avatars are only
+  served animated as AVIF, and `static=true` requests their first frame instead
+- GET /api/avatar/default/:userId - Get the generated default avatar of a user without an avatar,
+  accepts the same `size` and `format` query parameters
+- GET /api/rooms - List public rooms, accepts `q` (searches titles and descriptions), `sort` (members,
+  created or active), `limit` and `offset` query parameters. Only the 1000 newest matching rooms are
+  sorted and listed, with `truncated` set if there were more
+- GET /api/rooms/mine - List the rooms you own and the rooms you recently joined
+- POST /api/room - Create a new room, optionally with a `title`, `description`, `visibility` (public,
+  unlisted or private) and `password`
 - GET /api/room/:id - Get the room's info
-- PATCH /api/room/:id - Update the room's info
-- WS /api/room/:id/join - Join an existing room
-- GET /api/room/:id/subtitle - Get a subtitle from the room
-- POST /api/room/:id/subtitle - Add a subtitle to the room
+- PATCH /api/room/:id - Update the room's info, or its `title`, `description`, `persistent` flag
+  (archived instead of deleted when inactive), `visibility` and `password` (owner only)
+- WS /api/room/:id/join - Join an existing room, reactivating it if it was archived
+- GET /api/room/:id/chat/search?q=:query - Search the room's chat (members only), also accepts
+  `author`, `from`, `to` (RFC 3339), `limit` and `offset` query parameters
+- GET /api/room/:id/chat/export?format=:format - Export the room's chat as json, txt or html (members only)
+- GET /api/room/:id/subtitle?name=:name - Get a subtitle from the room as WebVTT, or in its original
+  format with `format=original` or an `Accept` header preferring it
+- POST /api/room/:id/subtitle?name=:name - Add a subtitle (SRT, WebVTT, ASS/SSA or TTML) to the room,
+  also accepts `language` (BCP 47), `label`, `forced` and `sdh` query parameters
+- PATCH /api/room/:id/subtitle?name=:name - Rename a subtitle or update its metadata (uploader or
+  moderators only)
+- DELETE /api/room/:id/subtitle?name=:name - Remove a subtitle from the room (uploader or moderators
+  only)
+- POST /api/room/:id/subtitle/retime?name=:name - Shift a subtitle by a constant `offset` (seconds), or
+  stretch it linearly between two sync `points` ({from, to} in seconds)
+- GET /api/room/:id/subtitle/versions?name=:name - List a subtitle's previous versions, newest first
+- GET /api/room/:id/subtitle/versions/:version?name=:name - Get a previous version of a subtitle, also
+  accepts `format=original`
+- POST /api/room/:id/subtitle/versions/:version/revert?name=:name - Save a previous version of a
+  subtitle as its latest version (moderators only)
+- GET /api/room/:id/subtitle/diff?name=:name - Summarise the cues added, removed and retimed between
+  two versions of a subtitle, given as `from` and `to` (defaults to the latest two versions)
+- GET /api/room/:id/subtitle/embedded - List the subtitle streams embedded in a remote file (with access)
+- POST /api/room/:id/subtitle/embedded - Extract the given embedded subtitle `streams` in the background,
+  with progress sent to the room as `subtitle_extraction` messages (with access, requires ffmpeg)
+- GET /api/room/:id/filters - Get the room's chat filters (moderators only)
+- POST /api/room/:id/filters - Add a chat filter to the room (moderators only)
+- DELETE /api/room/:id/filters/:filterId - Remove a chat filter from the room (moderators only)
+- GET /api/room/:id/moderation-log - Get the room's recent moderation actions (moderators only)
+- POST /api/room/:id/kick/:userId - Disconnect a user from the room (moderators only)
+- GET /api/room/:id/bans - Get the room's active bans (moderators only)
+- POST /api/room/:id/bans/:userId - Ban a user from the room, optionally with a `reason` and `duration`
+  (seconds, permanent if 0), disconnecting them (moderators only)
+- DELETE /api/room/:id/bans/:userId - Unban a user from the room (moderators only)
+- GET /api/room/:id/invites - Get the room's invite links (moderators only)
+- POST /api/room/:id/invites - Create an invite link, optionally with `expiresIn` (seconds) and `maxUses`
+  (moderators only)
+- DELETE /api/room/:id/invites/:inviteId - Revoke an invite link (moderators only)
+- POST /api/room/:id/invites/redeem - Become a member of the room using an invite link's `token`
 
-You can be a member of up to 3 rooms at once.
-Rooms are deleted after 10 minutes of no members.
+- GET /api/instance - Get the server's version and the limits clients should respect
+- GET /metrics - Prometheus metrics, served on `metricsPort` instead if configured
+
+Private rooms can only be accessed by their members, and password protected rooms can only be accessed
+by their members until they join with the password. Users become members by joining or using an invite.
+"With access" endpoints require such access, and "members only" endpoints also require joining the room
+or redeeming an invite to it. Users banned from a room cannot access it at all.
+
+You can be a member of up to 3 rooms at once (configurable with `limits.maxRoomsPerUser`).
+Rooms are deleted after 10 minutes of no members (configurable with `roomTtls`).
 */
 
 var db *sql.DB
-var config Config = Config{BasePath: "/", Port: 8000, Database: "postgres"}
+var config Config = Config{
+	BasePath: "/",
+	Port:     8000,
+	Database: "postgres",
+	RoomTTLs: RoomTTLConfig{Inactive: 10, Persistent: 7 * 24 * 60},
+	Limits: LimitsConfig{
+		MaxRoomsPerUser:        3,
+		PasswordResetTTL:       10,
+		MaxChatMessageLength:   2000,
+		MaxSubtitleSize:        1024,
+		MaxAvatarSize:          16,
+		MaxAvatarResolution:    4096,
+		MaxAvatarFrames:        300,
+		MaxAvatarDuration:      30,
+		MaxAnimatedResolution:  512,
+		WriteChannelSize:       16,
+		WebSocketTimeout:       30,
+		MaxDatabaseConnections: 10,
+		AvatarCacheSize:        64,
+		ImageWorkers:           runtime.NumCPU(),
+		ImageTimeout:           60,
+	},
+	ImagePipeline:     ImagePipelineLibavif,
+	LogFormat:         LogFormatText,
+	DrainTimeout:      30,
+	AvatarGracePeriod: 60,
+	DefaultAvatarPalette: []string{
+		"#e53935", "#d81b60", "#8e24aa", "#5e35b1", "#3949ab", "#1e88e5", "#039be5", "#00897b",
+		"#43a047", "#7cb342", "#f4511e", "#fb8c00", "#6d4c41", "#546e7a"},
+}
 
 type Config struct {
 	Port          int    `json:"port"`
@@ -59,6 +150,86 @@ type Config struct {
 		Password string `json:"password"`
 		Host     string `json:"host"`
 	} `json:"emailSettings"`
+	ChatFilters        []ChatFilter  `json:"chatFilters"`
+	RoomTTLs           RoomTTLConfig `json:"roomTtls"`
+	MaxPersistentRooms int           `json:"maxPersistentRooms"` // Per user, 0 for unlimited
+	Limits             LimitsConfig  `json:"limits"`
+	ImagePipeline      string        `json:"imagePipeline"` // libavif or go, see codecs.go
+	LogFormat          string        `json:"logFormat"`     // text or json, see logging.go
+	MetricsPort        int           `json:"metricsPort"`   // Serves /metrics separately if not 0
+	DrainTimeout       int           `json:"drainTimeout"`  // Seconds to wait for connections on shutdown
+	ShutdownDelay      int           `json:"shutdownDelay"` // Seconds /readyz fails before shutting down
+	// Whether ffmpeg can read room media from private networks, see media_proxy.go
+	AllowPrivateMediaHosts bool `json:"allowPrivateMediaHosts"`
+	// Hex colours which default avatars are drawn in, see identicons.go
+	DefaultAvatarPalette []string `json:"defaultAvatarPalette"`
+	// Minutes an avatar is kept after it is no longer used, see avatar_storage.go
+	AvatarGracePeriod int `json:"avatarGracePeriod"`
+	// Directory to store avatar images in instead of the database, see avatar_storage.go
+	AvatarStoragePath string `json:"avatarStoragePath"`
+}
+
+// RoomTTLConfig configures how long rooms are kept without activity or members, in minutes.
+type RoomTTLConfig struct {
+	Inactive   int `json:"inactive"`   // Until a room is deleted
+	Persistent int `json:"persistent"` // Until a persistent room is archived
+	Archived   int `json:"archived"`   // Until an archived room is deleted, 0 to keep it forever
+}
+
+// LimitsConfig configures the limits enforced by the server. Omitted limits keep their defaults.
+type LimitsConfig struct {
+	MaxRoomsPerUser        int `json:"maxRoomsPerUser"`        // Rooms a user can be connected to at once
+	PasswordResetTTL       int `json:"passwordResetTtl"`       // Minutes until password reset links expire
+	MaxChatMessageLength   int `json:"maxChatMessageLength"`   // Bytes
+	MaxSubtitleSize        int `json:"maxSubtitleSize"`        // KB
+	MaxAvatarSize          int `json:"maxAvatarSize"`          // MB, before the avatar is re-encoded
+	MaxAvatarResolution    int `json:"maxAvatarResolution"`    // Pixels, avatars are downscaled to fit
+	MaxAvatarFrames        int `json:"maxAvatarFrames"`        // Frames in an animated avatar
+	MaxAvatarDuration      int `json:"maxAvatarDuration"`      // Seconds an animated avatar can play for
+	MaxAnimatedResolution  int `json:"maxAnimatedResolution"`  // Pixels, animated avatars are downscaled to fit
+	WriteChannelSize       int `json:"writeChannelSize"`       // Messages queued per WebSocket connection
+	WebSocketTimeout       int `json:"webSocketTimeout"`       // Seconds to wait for a client to read or write
+	MaxDatabaseConnections int `json:"maxDatabaseConnections"` // Open connections in the database pool
+	AvatarCacheSize        int `json:"avatarCacheSize"`        // MB of avatars cached in memory, 0 to disable
+	ImageWorkers           int `json:"imageWorkers"`           // Images encoded or decoded at once
+	ImageTimeout           int `json:"imageTimeout"`           // Seconds to encode or decode an image
+}
+
+// Validate checks that every limit is in a range the server and database schema can support.
+func (l LimitsConfig) Validate() error {
+	switch {
+	case l.MaxRoomsPerUser < 1:
+		return errors.New("maxRoomsPerUser must be at least 1")
+	case l.PasswordResetTTL < 1:
+		return errors.New("passwordResetTtl must be at least 1 minute")
+	case l.MaxChatMessageLength < 1 || l.MaxChatMessageLength > 65535: // Size of a TEXT column in MySQL
+		return errors.New("maxChatMessageLength must be between 1 and 65535")
+	case l.MaxSubtitleSize < 1 || l.MaxSubtitleSize > 16*1024: // Size of a MEDIUMTEXT column in MySQL
+		return errors.New("maxSubtitleSize must be between 1 and 16384 KB")
+	case l.MaxAvatarSize < 1 || l.MaxAvatarSize > 1024:
+		return errors.New("maxAvatarSize must be between 1 and 1024 MB")
+	case l.MaxAvatarResolution < 256 || l.MaxAvatarResolution > 16384: // 256 is the smallest avatar size served
+		return errors.New("maxAvatarResolution must be between 256 and 16384")
+	case l.MaxAvatarFrames < 1:
+		return errors.New("maxAvatarFrames must be at least 1")
+	case l.MaxAvatarDuration < 1:
+		return errors.New("maxAvatarDuration must be at least 1 second")
+	case l.MaxAnimatedResolution < 256 || l.MaxAnimatedResolution > l.MaxAvatarResolution:
+		return errors.New("maxAnimatedResolution must be between 256 and maxAvatarResolution")
+	case l.WriteChannelSize < 1:
+		return errors.New("writeChannelSize must be at least 1")
+	case l.WebSocketTimeout < 15: // Clients ping every 10 seconds
+		return errors.New("webSocketTimeout must be at least 15 seconds")
+	case l.MaxDatabaseConnections < 1:
+		return errors.New("maxDatabaseConnections must be at least 1")
+	case l.AvatarCacheSize < 0:
+		return errors.New("avatarCacheSize cannot be negative")
+	case l.ImageWorkers < 1:
+		return errors.New("imageWorkers must be at least 1")
+	case l.ImageTimeout < 1:
+		return errors.New("imageTimeout must be at least 1 second")
+	}
+	return nil
 }
 
 // TODO: implement e-mail verification option
@@ -68,20 +239,44 @@ func main() {
 		return
 	}
 
-	log.SetOutput(os.Stderr)
 	configFile, err := os.ReadFile("config.json")
 	if err != nil {
-		log.Fatalln("Failed to read config file!", err)
+		fatal("Failed to read config file!", "error", err)
 	}
 	err = json.Unmarshal(configFile, &config)
 	if err != nil {
-		log.Fatalln("Failed to parse config file!", err)
+		fatal("Failed to parse config file!", "error", err)
+	}
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		fatal("Unsupported log format specified in config!", "logFormat", config.LogFormat)
+	}
+	InitLogger()
+	if config.RoomTTLs.Inactive <= 0 || config.RoomTTLs.Persistent <= 0 || config.RoomTTLs.Archived < 0 {
+		fatal("Invalid room TTLs specified in config!")
+	}
+	if err = config.Limits.Validate(); err != nil {
+		fatal("Invalid limits specified in config!", "error", err)
+	}
+	if config.ImagePipeline != ImagePipelineLibavif && config.ImagePipeline != ImagePipelineGo {
+		fatal("Unsupported image pipeline specified in config!", "imagePipeline", config.ImagePipeline)
+	}
+	if config.DrainTimeout < 1 || config.ShutdownDelay < 0 {
+		fatal("Invalid drain timeout or shutdown delay specified in config!")
+	}
+	if config.AvatarGracePeriod < 1 {
+		fatal("Invalid avatar grace period specified in config!")
+	}
+	if err = InitIdenticonPalette(); err != nil {
+		fatal("Invalid default avatar palette specified in config!", "error", err)
+	}
+	if err = CompileChatFilters(); err != nil {
+		fatal("Failed to parse chat filters in config!", "error", err)
 	}
 	if config.Database == "mariadb" {
 		config.Database = "mysql"
 		dsn, err := mysql.ParseDSN(config.DatabaseURL)
 		if err != nil {
-			log.Fatalln("Failed to parse MariaDB DSN!", err)
+			fatal("Failed to parse MariaDB DSN!", "error", err)
 		}
 		dsn.MultiStatements = true
 		dsn.ParseTime = true
@@ -89,21 +284,37 @@ func main() {
 		dsn.ClientFoundRows = true
 		config.DatabaseURL = dsn.FormatDSN()
 	} else if config.Database != "postgres" {
-		log.Fatalln("Unsupported database \"" + config.Database + "\" specified in config!")
+		fatal("Unsupported database specified in config!", "database", config.Database)
 	}
 	db, err = sql.Open(config.Database, config.DatabaseURL)
 	if err != nil {
-		log.Fatalln("Failed to open connection to database!", err)
+		fatal("Failed to open connection to database!", "error", err)
 	}
-	db.SetMaxOpenConns(10)
+	db.SetMaxOpenConns(config.Limits.MaxDatabaseConnections)
 	CreateSqlTables()
 	if slices.Contains(os.Args, "--upgrade") {
 		UpgradeSqlTables()
 	}
 	PrepareSqlStatements()
-	go PurgeExpiredDataTask()
+	if err = InitAvatarBlobStore(); err != nil {
+		fatal("Failed to create avatar storage directory!", "error", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "avatar-storage" {
+		if err = PrintAvatarStorageReport(); err != nil {
+			fatal("Failed to report avatar storage usage!", "error", err)
+		}
+		return
+	}
+	InitAvatarCache()
+	InitImageCodecs()
+	tasksCtx, stopTasks := context.WithCancel(context.Background())
+	tasksStopped := make(chan struct{})
+	go (func() {
+		PurgeExpiredDataTask(tasksCtx)
+		close(tasksStopped)
+	})()
 	if !IsEmailConfigured() || config.FrontendURL == "" {
-		log.Println("Note: Email settings and frontend URL are not configured for the forgot password functionality!")
+		slog.Warn("Note: Email settings and frontend URL are not configured for the forgot password functionality!")
 	}
 
 	// Endpoints
@@ -114,6 +325,9 @@ func main() {
 			StatusEndpoint(w, r)
 		}
 	})
+	http.HandleFunc("GET /healthz", HealthzEndpoint)
+	http.HandleFunc("GET /readyz", ReadyzEndpoint)
+	http.HandleFunc("GET /api/instance", GetInstanceEndpoint)
 	http.HandleFunc("POST /api/login", LoginEndpoint)
 	http.HandleFunc("POST /api/logout", LogoutEndpoint)
 	http.HandleFunc("POST /api/register", RegisterEndpoint)
@@ -127,24 +341,78 @@ func main() {
 	http.HandleFunc("GET /api/profiles", GetUserProfilesEndpoint)
 	http.HandleFunc("POST /api/avatar", ChangeAvatarEndpoint)
 	http.HandleFunc("GET /api/avatar/{hash}", GetAvatarEndpoint)
+	http.HandleFunc("GET /api/avatar/default/{userId}", GetDefaultAvatarEndpoint)
+	http.HandleFunc("GET /api/rooms", GetRoomsEndpoint)
+	http.HandleFunc("GET /api/rooms/mine", GetOwnRoomsEndpoint)
 	http.HandleFunc("POST /api/room", CreateRoomEndpoint)
 	http.HandleFunc("GET /api/room/{id}", GetRoomEndpoint)
 	http.HandleFunc("PATCH /api/room/{id}", UpdateRoomEndpoint)
 	http.HandleFunc("GET /api/room/{id}/join", JoinRoomEndpoint)
+	http.HandleFunc("GET /api/room/{id}/chat/search", SearchChatEndpoint)
+	http.HandleFunc("GET /api/room/{id}/chat/export", ExportChatEndpoint)
 	http.HandleFunc("GET /api/room/{id}/subtitle", GetRoomSubtitleEndpoint)
 	http.HandleFunc("POST /api/room/{id}/subtitle", CreateRoomSubtitleEndpoint)
+	http.HandleFunc("PATCH /api/room/{id}/subtitle", UpdateRoomSubtitleEndpoint)
+	http.HandleFunc("DELETE /api/room/{id}/subtitle", DeleteRoomSubtitleEndpoint)
+	http.HandleFunc("POST /api/room/{id}/subtitle/retime", RetimeRoomSubtitleEndpoint)
+	http.HandleFunc("GET /api/room/{id}/subtitle/versions", GetRoomSubtitleVersionsEndpoint)
+	http.HandleFunc("GET /api/room/{id}/subtitle/versions/{version}", GetRoomSubtitleVersionEndpoint)
+	http.HandleFunc("POST /api/room/{id}/subtitle/versions/{version}/revert", RevertRoomSubtitleEndpoint)
+	http.HandleFunc("GET /api/room/{id}/subtitle/diff", DiffRoomSubtitleEndpoint)
+	http.HandleFunc("GET /api/room/{id}/subtitle/embedded", GetRoomEmbeddedSubtitlesEndpoint)
+	http.HandleFunc("POST /api/room/{id}/subtitle/embedded", ExtractRoomEmbeddedSubtitlesEndpoint)
+	http.HandleFunc("GET /api/room/{id}/filters", GetRoomFiltersEndpoint)
+	http.HandleFunc("POST /api/room/{id}/filters", CreateRoomFilterEndpoint)
+	http.HandleFunc("DELETE /api/room/{id}/filters/{filterId}", DeleteRoomFilterEndpoint)
+	http.HandleFunc("GET /api/room/{id}/moderation-log", GetModerationLogEndpoint)
+	http.HandleFunc("POST /api/room/{id}/kick/{userId}", KickRoomMemberEndpoint)
+	http.HandleFunc("GET /api/room/{id}/bans", GetRoomBansEndpoint)
+	http.HandleFunc("POST /api/room/{id}/bans/{userId}", BanRoomMemberEndpoint)
+	http.HandleFunc("DELETE /api/room/{id}/bans/{userId}", UnbanRoomMemberEndpoint)
+	http.HandleFunc("GET /api/room/{id}/invites", GetRoomInvitesEndpoint)
+	http.HandleFunc("POST /api/room/{id}/invites", CreateRoomInviteEndpoint)
+	http.HandleFunc("DELETE /api/room/{id}/invites/{inviteId}", DeleteRoomInviteEndpoint)
+	http.HandleFunc("POST /api/room/{id}/invites/redeem", RedeemRoomInviteEndpoint)
 
 	port := strconv.Itoa(config.Port)
 	if os.Getenv("PORT") != "" {
 		port = os.Getenv("PORT")
 	}
-	log.SetOutput(os.Stdout)
-	log.Println("Listening to port " + port)
-	log.SetOutput(os.Stderr)
-	log.Fatalln(http.ListenAndServe(":"+port, handlers.CORS(
+	servers := make([]*http.Server, 0, 2)
+	if config.MetricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", MetricsEndpoint)
+		metricsServer := &http.Server{Addr: ":" + strconv.Itoa(config.MetricsPort), Handler: metricsMux}
+		servers = append(servers, metricsServer)
+		go (func() {
+			slog.Info("Serving metrics on port " + strconv.Itoa(config.MetricsPort))
+			err := metricsServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal("Failed to listen to metrics port!", "error", err)
+			}
+		})()
+	} else {
+		http.HandleFunc("GET /metrics", MetricsEndpoint)
+	}
+
+	server := &http.Server{Addr: ":" + port, Handler: RequestLogger(handlers.CORS(
 		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PATCH", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "X-Request-ID"}),
+		handlers.ExposedHeaders([]string{"X-Request-ID", "X-Avatar-Animated"}),
 		handlers.AllowedOrigins([]string{"*"}), // Breaks credentialed auth
 		handlers.AllowCredentials(),
-	)(http.DefaultServeMux)))
+	)(http.DefaultServeMux))}
+	servers = slices.Insert(servers, 0, server) // Shut down first, so metrics can be scraped while draining
+	go (func() {
+		slog.Info("Listening to port " + port)
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Failed to listen to port!", "error", err)
+		}
+	})()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop() // A second signal exits immediately
+	GracefulShutdown(servers, stopTasks, tasksStopped)
 }
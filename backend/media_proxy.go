@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Room media URLs are chosen by users, so ffmpeg must not be able to reach the server's internal
+// network through them. ffmpeg resolves hosts and follows redirects itself, so instead of checking
+// URLs up front, ffmpeg and ffprobe connect through this proxy, which refuses to connect to private
+// addresses. Redirects are passed back to ffmpeg, so every hop goes through the proxy as well.
+
+var ErrPrivateMediaHost = errors.New("media host is on a private network")
+
+// 0.0.0.0/8 reaches the local host on Linux, and 100.64.0.0/10 is shared by carrier-grade NAT.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// isPublicAddr returns whether an address is outside loopback, private, link-local and unspecified
+// ranges.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// mediaDialer checks every address it connects to after resolving it, so DNS rebinding is caught too.
+var mediaDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network string, address string, c syscall.RawConn) error {
+		if config.AllowPrivateMediaHosts {
+			return nil
+		}
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil || !isPublicAddr(addrPort.Addr()) {
+			return ErrPrivateMediaHost
+		}
+		return nil
+	},
+}
+
+// CheckMediaHost rejects media URLs whose host resolves to a private address, so users get a clear
+// error instead of ffmpeg failing to connect through the proxy.
+func CheckMediaHost(ctx context.Context, mediaUrl string) error {
+	if config.AllowPrivateMediaHosts {
+		return nil
+	}
+	parsed, err := url.Parse(mediaUrl)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return ErrPrivateMediaHost
+		}
+	}
+	return nil
+}
+
+// MediaProxyURL starts the proxy on a random local port the first time it is called, returning the
+// URL to pass to ffmpeg with -http_proxy.
+var MediaProxyURL = sync.OnceValues(func() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	transport := &http.Transport{
+		Proxy:                 nil, // Never use the proxies in the environment
+		DialContext:           mediaDialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	server := &http.Server{Handler: mediaProxy{&httputil.ReverseProxy{
+		Rewrite:   func(r *httputil.ProxyRequest) {}, // Requests to proxies have absolute URLs already
+		Transport: transport,
+	}}}
+	go server.Serve(listener)
+	return "http://" + listener.Addr().String(), nil
+})
+
+type mediaProxy struct {
+	plain *httputil.ReverseProxy
+}
+
+func (p mediaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect { // Plain HTTP
+		if r.URL.Scheme != "http" || r.URL.Host == "" {
+			http.Error(w, "Only absolute http:// URLs can be proxied!", http.StatusBadRequest)
+			return
+		}
+		p.plain.ServeHTTP(w, r)
+		return
+	}
+
+	// HTTPS is tunnelled with CONNECT, so TLS is between ffmpeg and the host
+	upstream, err := mediaDialer.DialContext(r.Context(), "tcp", r.Host)
+	if errors.Is(err, ErrPrivateMediaHost) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	go (func() {
+		io.Copy(upstream, buffered)
+		upstream.Close() // Unblock the copy below once ffmpeg closes the connection
+	})()
+	io.Copy(client, upstream)
+}
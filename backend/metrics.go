@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// Metrics are exposed at /metrics in the Prometheus text format. Counters and histograms are
+// recorded as events happen, while gauges are read from the server's state on every scrape.
+
+var (
+	httpRequestsTotal = newCounterVec("concinnity_http_requests_total",
+		"HTTP requests handled, by route and status code.", "route", "status")
+	httpRequestDuration = newHistogramVec("concinnity_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route (excluding WebSockets).",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "route")
+	wsMessagesTotal = newCounterVec("concinnity_websocket_messages_total",
+		"WebSocket messages received from clients, by type.", "type")
+	broadcastDropsTotal = newCounterVec("concinnity_broadcast_drops_total",
+		"Broadcast messages dropped because a client's write queue was full, by type.", "type")
+	avatarEncodeDuration = newHistogramVec("concinnity_avatar_encode_duration_seconds",
+		"Time taken to encode avatar images, by format and whether they are animated.",
+		[]float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "format", "animated")
+	backgroundTaskRunsTotal = newCounterVec("concinnity_background_task_runs_total",
+		"Background task runs, by task.", "task")
+	backgroundTaskFailuresTotal = newCounterVec("concinnity_background_task_failures_total",
+		"Background task runs which failed, by task.", "task")
+)
+
+// WebSocket message types counted by wsMessagesTotal, other types are counted as invalid.
+var wsMessageTypes = []string{"chat", "player_state", "subtitle_offset", "typing", "ping"}
+
+// CountWebSocketMessage records a message received from a client.
+func CountWebSocketMessage(messageType string) {
+	if !slices.Contains(wsMessageTypes, messageType) {
+		messageType = "invalid"
+	}
+	wsMessagesTotal.Inc(messageType)
+}
+
+// trySend queues a message which can be dropped, such as a typing indicator, on a client's write
+// channel without waiting for a full queue to empty.
+func trySend(write chan<- interface{}, messageType string, msg interface{}) {
+	select {
+	case write <- msg:
+	default:
+		broadcastDropsTotal.Inc(messageType)
+	}
+}
+
+// runBackgroundTask runs a task of PurgeExpiredDataTask, recording whether it failed.
+func runBackgroundTask(task string, run func() error) {
+	backgroundTaskRunsTotal.Inc(task)
+	if err := run(); err != nil {
+		backgroundTaskFailuresTotal.Inc(task)
+		slog.Error("Background task failed!", "task", task, "error", err)
+	}
+}
+
+// metricLabels formats label names and values, escaping the values.
+func metricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	series *xsync.MapOf[string, *counterSeries]
+}
+
+type counterSeries struct {
+	labels []string
+	value  *xsync.Counter
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: xsync.NewMapOf[string, *counterSeries]()}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	series, _ := c.series.LoadOrCompute(strings.Join(labelValues, "\xff"), func() *counterSeries {
+		return &counterSeries{labels: labelValues, value: xsync.NewCounter()}
+	})
+	series.value.Inc()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.series.Range(func(key string, series *counterSeries) bool {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, metricLabels(c.labels, series.labels), series.value.Value())
+		return true
+	})
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labels: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = series
+	}
+	bucket, _ := slices.BinarySearch(h.buckets, value)
+	series.counts[bucket]++
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(slices.Clone(h.labels), "le")
+	for _, series := range h.series {
+		cumulative := uint64(0)
+		for i, count := range series.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			labelValues := append(slices.Clone(series.labels), formatMetricValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricLabels(labels, labelValues), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, metricLabels(h.labels, series.labels), formatMetricValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, metricLabels(h.labels, series.labels), series.count)
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatMetricValue(value))
+}
+
+func writeCounter(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatMetricValue(value))
+}
+
+// MetricsEndpoint serves every metric in the Prometheus text format.
+func MetricsEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	connections, activeRooms := 0, 0
+	roomMembers.Range(func(roomId string, members RoomMembers) bool {
+		if size := members.Size(); size > 0 {
+			connections += size
+			activeRooms++
+		}
+		return true
+	})
+	writeGauge(w, "concinnity_websocket_connections", "Open WebSocket connections to rooms.", float64(connections))
+	writeGauge(w, "concinnity_active_rooms", "Rooms with at least one member connected.", float64(activeRooms))
+
+	stats := db.Stats()
+	writeGauge(w, "concinnity_db_max_open_connections", "Maximum open database connections.",
+		float64(stats.MaxOpenConnections))
+	writeGauge(w, "concinnity_db_open_connections", "Open database connections.", float64(stats.OpenConnections))
+	writeGauge(w, "concinnity_db_in_use_connections", "Database connections in use.", float64(stats.InUse))
+	writeGauge(w, "concinnity_db_idle_connections", "Idle database connections.", float64(stats.Idle))
+	writeCounter(w, "concinnity_db_wait_count_total", "Times a database connection had to be waited for.",
+		float64(stats.WaitCount))
+	writeCounter(w, "concinnity_db_wait_duration_seconds_total", "Time spent waiting for database connections.",
+		stats.WaitDuration.Seconds())
+
+	httpRequestsTotal.write(w)
+	httpRequestDuration.write(w)
+	wsMessagesTotal.write(w)
+	broadcastDropsTotal.write(w)
+	avatarEncodeDuration.write(w)
+	backgroundTaskRunsTotal.write(w)
+	backgroundTaskFailuresTotal.write(w)
+}
+
+// observeHTTPRequest records a request handled by RequestLogger. Routes are the patterns requests
+// matched, so paths with IDs in them are grouped together.
+func observeHTTPRequest(r *http.Request, status int, duration time.Duration) {
+	route := r.Pattern
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequestsTotal.Inc(route, strconv.Itoa(status))
+	if status != http.StatusSwitchingProtocols {
+		httpRequestDuration.Observe(duration.Seconds(), route)
+	}
+}
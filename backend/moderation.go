@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+const (
+	ChatFilterMask   = "mask"   // Replace matches with asterisks
+	ChatFilterReject = "reject" // Refuse to send the message
+	ChatFilterFlag   = "flag"   // Send the message, but record it in the moderation log
+)
+
+type ChatFilter struct {
+	ID      int    `json:"id,omitempty"` // 0 for server-wide filters
+	Pattern string `json:"pattern"`
+	Regex   bool   `json:"regex"`
+	Action  string `json:"action"`
+
+	compiled  *regexp.Regexp
+	wordStart bool // If matches must not be preceded by a word character
+	wordEnd   bool // If matches must not be followed by a word character
+}
+
+// Compile validates the filter and prepares it for use. Plain patterns are matched as whole
+// words, and all patterns are matched case-insensitively.
+func (f *ChatFilter) Compile() error {
+	if f.Action != ChatFilterMask && f.Action != ChatFilterReject && f.Action != ChatFilterFlag {
+		return errors.New("invalid chat filter action \"" + f.Action + "\"")
+	} else if f.Pattern == "" || len(f.Pattern) > 200 {
+		return errors.New("chat filter patterns must be 1-200 characters long")
+	}
+	// Word boundaries are checked by find, since \b in Go regexps only treats ASCII as word characters
+	expr := f.Pattern
+	if !f.Regex {
+		expr = regexp.QuoteMeta(f.Pattern)
+		first, _ := utf8.DecodeRuneInString(f.Pattern)
+		last, _ := utf8.DecodeLastRuneInString(f.Pattern)
+		f.wordStart, f.wordEnd = isWordChar(first), isWordChar(last)
+	}
+	compiled, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return err
+	}
+	f.compiled = compiled
+	return nil
+}
+
+// find returns the byte ranges of the filter's matches in a message.
+func (f *ChatFilter) find(msg string) [][]int {
+	return slices.DeleteFunc(f.compiled.FindAllStringIndex(msg, -1), func(match []int) bool {
+		before, _ := utf8.DecodeLastRuneInString(msg[:match[0]])
+		after, _ := utf8.DecodeRuneInString(msg[match[1]:])
+		return (f.wordStart && isWordChar(before)) || (f.wordEnd && isWordChar(after))
+	})
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// CompileChatFilters compiles the server-wide chat filters in the config.
+func CompileChatFilters() error {
+	for i := range config.ChatFilters {
+		if err := config.ChatFilters[i].Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var roomFilters *xsync.MapOf[string, []ChatFilter] = xsync.NewMapOf[string, []ChatFilter]()
+
+// GetRoomFilters returns the compiled chat filters of a room, loading them from the database if
+// they are not cached already.
+func GetRoomFilters(roomId string) ([]ChatFilter, error) {
+	if filters, ok := roomFilters.Load(roomId); ok {
+		return filters, nil
+	}
+	filters, err := FindRoomFilters(roomId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range filters {
+		if err := filters[i].Compile(); err != nil {
+			return nil, err
+		}
+	}
+	roomFilters.Store(roomId, filters)
+	return filters, nil
+}
+
+// FilterChatMessage applies the server-wide and room chat filters to a message, returning the
+// masked message, whether it should be rejected, and the patterns it was flagged for (if any).
+func FilterChatMessage(roomId string, msg string) (string, bool, []string, error) {
+	filters, err := GetRoomFilters(roomId)
+	if err != nil {
+		return "", false, nil, err
+	}
+	var flagged []string
+	for _, filter := range slices.Concat(config.ChatFilters, filters) {
+		matches := filter.find(msg)
+		if len(matches) == 0 {
+			continue
+		}
+		switch filter.Action {
+		case ChatFilterReject:
+			return "", true, nil, nil
+		case ChatFilterFlag:
+			flagged = append(flagged, filter.Pattern)
+		case ChatFilterMask:
+			var masked strings.Builder
+			position := 0
+			for _, match := range matches {
+				masked.WriteString(msg[position:match[0]])
+				masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(msg[match[0]:match[1]])))
+				position = match[1]
+			}
+			masked.WriteString(msg[position:])
+			msg = masked.String()
+		}
+	}
+	return msg, false, flagged, nil
+}
+
+var roomMutes *xsync.MapOf[string, *xsync.MapOf[uuid.UUID, time.Time]] = xsync.NewMapOf[string, *xsync.MapOf[uuid.UUID, time.Time]]()
+
+// LoadRoomMutes caches the active mutes of a room from the database, if not cached already.
+func LoadRoomMutes(roomId string) error {
+	if _, ok := roomMutes.Load(roomId); ok {
+		return nil
+	}
+	mutes, err := FindRoomMutes(roomId)
+	if err != nil {
+		return err
+	}
+	cached := xsync.NewMapOf[uuid.UUID, time.Time]()
+	for userId, expiresAt := range mutes {
+		cached.Store(userId, expiresAt)
+	}
+	roomMutes.LoadOrStore(roomId, cached)
+	return nil
+}
+
+// GetMuteExpiry returns when a user's mute in a room expires, or the zero time if not muted.
+func GetMuteExpiry(roomId string, userId uuid.UUID) time.Time {
+	if mutes, ok := roomMutes.Load(roomId); ok {
+		if expiresAt, ok := mutes.Load(userId); ok && expiresAt.After(time.Now()) {
+			return expiresAt
+		}
+	}
+	return time.Time{}
+}
+
+func SetMuteExpiry(roomId string, userId uuid.UUID, expiresAt time.Time) {
+	mutes, _ := roomMutes.LoadOrStore(roomId, xsync.NewMapOf[uuid.UUID, time.Time]())
+	if expiresAt.IsZero() {
+		mutes.Delete(userId)
+	} else {
+		mutes.Store(userId, expiresAt)
+	}
+}
+
+const maxRoomBanDuration = 365 * 24 * time.Hour
+const maxRoomBanReasonLength = 200
+
+// Message returns the error shown to a banned user when they try to join the room.
+func (b RoomBan) Message() string {
+	msg := "You are banned from this room"
+	if b.ExpiresAt != nil {
+		msg += " until " + b.ExpiresAt.UTC().Format(time.RFC1123)
+	}
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	return msg + "!"
+}
+
+// RemoveFromRoom disconnects all of a user's connections to a room with WsInternalKick or
+// WsInternalBan, returning whether the user was connected.
+func RemoveFromRoom(roomId string, userId uuid.UUID, signal int) bool {
+	removed := false
+	if members, ok := roomMembers.Load(roomId); ok {
+		members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+			if connId.UserID == userId {
+				write <- signal
+				removed = true
+			}
+			return true
+		})
+	}
+	return removed
+}
+
+// KickFromRoom disconnects a user from a room and announces it in the room's chat, returning false
+// if they were not connected.
+func KickFromRoom(roomId string, moderatorId uuid.UUID, userId uuid.UUID) (bool, error) {
+	if !RemoveFromRoom(roomId, userId, WsInternalKick) {
+		return false, nil
+	} else if err := InsertModerationLog(roomId, &moderatorId, &userId, "kick", ""); err != nil {
+		return false, err
+	}
+	return true, BroadcastSystemMessage(roomId, userId, "was kicked")
+}
+
+// BanFromRoom bans a user from a room for some duration (permanently if 0), disconnecting them and
+// announcing the ban in the room's chat.
+func BanFromRoom(
+	roomId string, moderatorId uuid.UUID, userId uuid.UUID, reason string, duration time.Duration,
+) error {
+	var expiresAt *time.Time
+	details := "Banned permanently"
+	announcement := "was banned"
+	if duration > 0 {
+		expiry := time.Now().UTC().Add(duration)
+		expiresAt = &expiry
+		details = "Banned for " + duration.String()
+		announcement += " for " + duration.String()
+	}
+	if reason != "" {
+		details += ": " + reason
+	}
+	if err := UpsertRoomBan(roomId, userId, moderatorId, reason, expiresAt); err != nil {
+		return err
+	} else if _, err := deleteRoomMemberStmt.Exec(roomId, userId); err != nil {
+		return err // Banned users must be invited or use the password again once unbanned
+	} else if err := InsertModerationLog(roomId, &moderatorId, &userId, "ban", details); err != nil {
+		return err
+	}
+	RemoveFromRoom(roomId, userId, WsInternalBan)
+	return BroadcastSystemMessage(roomId, userId, announcement)
+}
+
+// UnbanFromRoom lifts a user's ban from a room, returning false if they were not banned.
+func UnbanFromRoom(roomId string, moderatorId uuid.UUID, userId uuid.UUID) (bool, error) {
+	result, err := deleteRoomBanStmt.Exec(roomId, userId)
+	if err != nil {
+		return false, err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if rows != 1 {
+		return false, nil
+	} else if err := InsertModerationLog(roomId, &moderatorId, &userId, "unban", ""); err != nil {
+		return false, err
+	}
+	return true, BroadcastSystemMessage(roomId, userId, "was unbanned")
+}
+
+// BroadcastSystemMessage stores a system chat message and sends it to every member of the room.
+func BroadcastSystemMessage(roomId string, subjectId uuid.UUID, msg string) error {
+	chatMsg := ChatMessage{UserID: uuid.Nil, SubjectID: &subjectId, Message: msg}
+	var err error
+	chatMsg.ID, chatMsg.Timestamp, err = InsertChatMessage(roomId, nil, systemMessageText(subjectId, msg))
+	if err != nil {
+		return err
+	}
+	if members, ok := roomMembers.Load(roomId); ok {
+		members.Range(func(connId RoomConnID, write chan<- interface{}) bool {
+			write <- ChatMessageOutgoing{Type: "chat", Data: []ChatMessage{chatMsg}}
+			return true
+		})
+	}
+	return nil
+}
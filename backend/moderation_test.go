@@ -0,0 +1,102 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChatFilterCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  ChatFilter
+		wantErr bool
+	}{
+		{"plain", ChatFilter{Pattern: "bad", Action: ChatFilterMask}, false},
+		{"regex", ChatFilter{Pattern: `b[a4]d`, Regex: true, Action: ChatFilterReject}, false},
+		{"invalid regex", ChatFilter{Pattern: `b(ad`, Regex: true, Action: ChatFilterFlag}, true},
+		{"invalid action", ChatFilter{Pattern: "bad", Action: "delete"}, true},
+		{"empty pattern", ChatFilter{Pattern: "", Action: ChatFilterMask}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.filter.Compile(); (err != nil) != test.wantErr {
+				t.Errorf("Compile() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestChatFilterWordBoundaries(t *testing.T) {
+	tests := []struct {
+		pattern string
+		regex   bool
+		msg     string
+		want    bool
+	}{
+		{"bad", false, "that is bad", true},
+		{"bad", false, "BAD!", true},
+		{"bad", false, "badge", false},
+		{"bad", false, "sinbad", false},
+		{"bad", false, "bad_word", false},
+		{"bad", false, "bad1", false},
+		{"bad", false, "badé", false},
+		{"über", false, "so über cool", true},
+		{"über", false, "überall", false},
+		{"café", false, "a café.", true},
+		{"café", false, "cafés", false},
+		{"a.b", false, "axb", false},
+		{"a.b", false, "see a.b", true},
+		{"!!", false, "hi!!!", true}, // Patterns not starting or ending with a word character
+		{"-bad", false, "not-bad", true},
+		{"bad", true, "badge", true}, // Regexes are not restricted to whole words
+	}
+	for _, test := range tests {
+		filter := ChatFilter{Pattern: test.pattern, Regex: test.regex, Action: ChatFilterFlag}
+		if err := filter.Compile(); err != nil {
+			t.Fatalf("Compile(%q) error = %v", test.pattern, err)
+		}
+		if got := len(filter.find(test.msg)) > 0; got != test.want {
+			t.Errorf("filter %q matches %q = %v, want %v", test.pattern, test.msg, got, test.want)
+		}
+	}
+}
+
+func TestFilterChatMessage(t *testing.T) {
+	roomId := "test-filter-room"
+	filters := []ChatFilter{
+		{Pattern: "darn", Action: ChatFilterMask},
+		{Pattern: "größe", Action: ChatFilterMask},
+		{Pattern: "spam", Action: ChatFilterFlag},
+		{Pattern: `https?://evil\.example`, Regex: true, Action: ChatFilterReject},
+	}
+	for i := range filters {
+		if err := filters[i].Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roomFilters.Store(roomId, filters)
+	defer roomFilters.Delete(roomId)
+
+	tests := []struct {
+		msg      string
+		want     string
+		rejected bool
+		flagged  []string
+	}{
+		{"hello", "hello", false, nil},
+		{"darn it, DARN", "**** it, ****", false, nil},
+		{"darned", "darned", false, nil},
+		{"die Größe, größer", "die *****, größer", false, nil},
+		{"darn spam", "**** spam", false, []string{"spam"}},
+		{"see http://evil.example", "", true, nil},
+	}
+	for _, test := range tests {
+		got, rejected, flagged, err := FilterChatMessage(roomId, test.msg)
+		if err != nil {
+			t.Fatal(err)
+		} else if got != test.want || rejected != test.rejected || !slices.Equal(flagged, test.flagged) {
+			t.Errorf("FilterChatMessage(%q) = %q, %v, %v, want %q, %v, %v", test.msg,
+				got, rejected, flagged, test.want, test.rejected, test.flagged)
+		}
+	}
+}
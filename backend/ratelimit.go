@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// TokenBucket is a thread-safe token bucket rate limiter. It starts full, and refills one token
+// per interval up to its capacity.
+type TokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(capacity int, interval time.Duration) *TokenBucket {
+	return &TokenBucket{
+		capacity: float64(capacity),
+		interval: interval,
+		tokens:   float64(capacity),
+		last:     time.Now(),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens = min(b.capacity, b.tokens+float64(now.Sub(b.last))/float64(b.interval))
+	b.last = now
+}
+
+// Take consumes a token if one is available. Otherwise, it returns how long until one is.
+func (b *TokenBucket) Take() (ok bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(b.interval))
+}
+
+// Full returns whether the bucket has refilled completely, i.e. it has not been used recently.
+func (b *TokenBucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= b.capacity
+}
+
+// UserRateLimits are shared across all of a user's connections, so opening more connections does
+// not allow a user to send more messages.
+type UserRateLimits struct {
+	Chat         *TokenBucket
+	Typing       *TokenBucket
+	PlayerState  *TokenBucket
+	RoomPassword *TokenBucket
+	MediaProbe   *TokenBucket // Reading a room's media with ffprobe
+}
+
+var userRateLimits *xsync.MapOf[uuid.UUID, *UserRateLimits] = xsync.NewMapOf[uuid.UUID, *UserRateLimits]()
+
+func GetUserRateLimits(userId uuid.UUID) *UserRateLimits {
+	limits, _ := userRateLimits.LoadOrCompute(userId, func() *UserRateLimits {
+		return &UserRateLimits{
+			Chat:         NewTokenBucket(5, time.Second),
+			Typing:       NewTokenBucket(10, 500*time.Millisecond),
+			PlayerState:  NewTokenBucket(20, 200*time.Millisecond),
+			RoomPassword: NewTokenBucket(5, time.Minute),
+			MediaProbe:   NewTokenBucket(5, 30*time.Second),
+		}
+	})
+	return limits
+}
+
+// NewAbuseLimiter returns a bucket tracking rate limit violations on a single connection. Once it
+// runs out, the connection should be closed.
+func NewAbuseLimiter() *TokenBucket {
+	return NewTokenBucket(10, 3*time.Second)
+}
+
+// CleanIdleRateLimits forgets the rate limits of disconnected users who have not sent anything
+// recently, as they would be recreated in the same state anyway.
+func CleanIdleRateLimits() {
+	userRateLimits.Range(func(userId uuid.UUID, limits *UserRateLimits) bool {
+		if _, ok := userConns.Load(userId); !ok &&
+			limits.Chat.Full() && limits.Typing.Full() && limits.PlayerState.Full() &&
+			limits.RoomPassword.Full() && limits.MediaProbe.Full() {
+			userRateLimits.Delete(userId)
+		}
+		return true
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// elapse pretends time has passed since the bucket was last used.
+func (b *TokenBucket) elapse(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last = b.last.Add(-d)
+}
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		take     int           // Tokens taken before time passes
+		elapsed  time.Duration // Time passed afterwards
+		wantOk   int           // Tokens which can be taken after that
+		wantFull bool          // If the bucket is full after time passes
+	}{
+		{"starts full", 3, 0, 0, 3, true},
+		{"runs out", 3, 3, 0, 0, false},
+		{"refills one token per interval", 3, 3, 2 * time.Minute, 2, false},
+		{"refills partial tokens", 3, 3, 90 * time.Second, 1, false},
+		{"refills up to capacity", 3, 3, time.Hour, 3, true},
+		{"refills after partial use", 3, 1, time.Minute, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := NewTokenBucket(test.capacity, time.Minute)
+			for i := range test.take {
+				if ok, _ := bucket.Take(); !ok {
+					t.Fatalf("Take() %d failed on a bucket with capacity %d", i+1, test.capacity)
+				}
+			}
+			bucket.elapse(test.elapsed)
+			if full := bucket.Full(); full != test.wantFull {
+				t.Errorf("Full() = %v, want %v", full, test.wantFull)
+			}
+			taken := 0
+			for taken <= test.capacity {
+				if ok, _ := bucket.Take(); !ok {
+					break
+				}
+				taken++
+			}
+			if taken != test.wantOk {
+				t.Errorf("took %d tokens, want %d", taken, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestTokenBucketRetryAfter(t *testing.T) {
+	bucket := NewTokenBucket(1, time.Minute)
+	if ok, retryAfter := bucket.Take(); !ok || retryAfter != 0 {
+		t.Fatalf("Take() = %v, %v, want true, 0", ok, retryAfter)
+	}
+	bucket.elapse(15 * time.Second)
+	ok, retryAfter := bucket.Take()
+	if ok {
+		t.Fatal("Take() succeeded on an empty bucket")
+	}
+	// Allow for the time taken by the test itself
+	if retryAfter > 45*time.Second || retryAfter < 44*time.Second {
+		t.Errorf("Take() retryAfter = %v, want about 45s", retryAfter)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// On SIGINT or SIGTERM, /readyz starts failing, and after shutdownDelay seconds (giving load
+// balancers time to notice), the server stops accepting connections and tells WebSocket clients to
+// reconnect after a short delay, by which time a new instance should be up. In-flight requests and
+// WebSocket connections are given up to drainTimeout seconds to finish before the server exits.
+
+// Clients are asked to wait a random delay in this range before reconnecting, so they don't all
+// reconnect to the new instance at once.
+const (
+	minReconnectDelay = 2 * time.Second
+	maxReconnectDelay = 10 * time.Second
+)
+
+var shuttingDown atomic.Bool
+
+// serverRestart is closed when the server begins shutting down, notifying every WebSocket connection.
+var serverRestart = make(chan struct{})
+
+// openWebSockets counts WebSocket connections, which http.Server.Shutdown does not wait for.
+var openWebSockets atomic.Int64
+
+// IsShuttingDown returns whether the server has begun shutting down.
+func IsShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// reconnectDelay returns the delay suggested to a client before reconnecting.
+func reconnectDelay() time.Duration {
+	return minReconnectDelay + rand.N(maxReconnectDelay-minReconnectDelay)
+}
+
+// GracefulShutdown shuts down the server, waiting for connections to close and then for background
+// tasks to stop, until the drain timeout is reached.
+func GracefulShutdown(servers []*http.Server, stopTasks context.CancelFunc, tasksStopped <-chan struct{}) {
+	shuttingDown.Store(true)
+	if config.ShutdownDelay > 0 {
+		slog.Info("Shutting down after delay...", "shutdown_delay", config.ShutdownDelay)
+		time.Sleep(time.Duration(config.ShutdownDelay) * time.Second)
+	}
+	slog.Info("Shutting down, draining connections...", "drain_timeout", config.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.DrainTimeout)*time.Second)
+	defer cancel()
+
+	close(serverRestart)
+	stopTasks()
+	var errs []error
+	for _, server := range servers {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for openWebSockets.Load() > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+	select {
+	case <-tasksStopped:
+	case <-ctx.Done():
+	}
+
+	if err := errors.Join(errs...); err != nil || ctx.Err() != nil {
+		slog.Warn("Drain timeout reached, exiting with connections open!",
+			"websocket_connections", openWebSockets.Load(), "error", err)
+	} else {
+		slog.Info("Shut down gracefully")
+	}
+}
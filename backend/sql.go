@@ -2,12 +2,15 @@ package main
 
 import (
 	"database/sql"
-	"log"
+	"log/slog"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 func CreateSqlTables() {
@@ -16,7 +19,17 @@ func CreateSqlTables() {
 CREATE TABLE IF NOT EXISTS avatars (
   hash VARCHAR(64) NOT NULL PRIMARY KEY,
 	data LONGBLOB NOT NULL,
-	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW());
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	animated BOOLEAN NOT NULL DEFAULT FALSE);
+
+CREATE TABLE IF NOT EXISTS avatar_variants (
+  hash VARCHAR(64) NOT NULL REFERENCES avatars(hash) ON DELETE CASCADE,
+	size INTEGER NOT NULL,
+	format VARCHAR(8) NOT NULL,
+	animated BOOLEAN NOT NULL,
+	data LONGBLOB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (hash, size, format, animated));
 
 CREATE TABLE IF NOT EXISTS users (
 	username VARCHAR(16) NOT NULL UNIQUE,
@@ -41,7 +54,33 @@ CREATE TABLE IF NOT EXISTS rooms (
 	paused BOOLEAN NOT NULL DEFAULT TRUE,
 	speed DECIMAL NOT NULL DEFAULT 1,
 	timestamp DECIMAL NOT NULL DEFAULT 0,
-	last_action TIMESTAMPTZ NOT NULL DEFAULT NOW());
+	last_action TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	owner_id UUID NULL DEFAULT NULL REFERENCES users(id) ON DELETE SET NULL,
+	slow_mode INTEGER NOT NULL DEFAULT 0, /* minimum seconds between chat messages per user */
+	subtitle_offset DOUBLE PRECISION NOT NULL DEFAULT 0, /* seconds, applied to all subtitles */
+	persistent BOOLEAN NOT NULL DEFAULT FALSE, /* archived instead of deleted when inactive */
+	archived_at TIMESTAMPTZ NULL DEFAULT NULL,
+	visibility VARCHAR(8) NOT NULL DEFAULT 'unlisted', /* public, unlisted, private */
+	password VARCHAR(100) NULL DEFAULT NULL,
+	title VARCHAR(100) NOT NULL DEFAULT '',
+	description VARCHAR(1000) NOT NULL DEFAULT '');
+
+CREATE TABLE IF NOT EXISTS room_members (
+	room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), /* last time the user joined the room */
+	PRIMARY KEY (room_id, user_id));
+CREATE INDEX IF NOT EXISTS room_members_user_id_idx ON room_members (user_id);
+
+CREATE TABLE IF NOT EXISTS room_invites (
+	id VARCHAR(24) NOT NULL PRIMARY KEY,
+	room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	creator_id UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NULL DEFAULT NULL,
+	max_uses INTEGER NOT NULL DEFAULT 0, /* 0 for unlimited */
+	uses INTEGER NOT NULL DEFAULT 0);
+CREATE INDEX IF NOT EXISTS room_invites_room_id_idx ON room_invites (room_id);
 
 CREATE TABLE IF NOT EXISTS chats (
   id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
@@ -50,27 +89,87 @@ CREATE TABLE IF NOT EXISTS chats (
 	message TEXT NOT NULL,
 	timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW());
 CREATE INDEX IF NOT EXISTS chats_room_id_idx ON chats (room_id);
+-- [#Postgres] CREATE INDEX IF NOT EXISTS chats_message_fts_idx ON chats USING GIN (to_tsvector('simple', message));
+-- [#MySQL]    CREATE FULLTEXT INDEX IF NOT EXISTS chats_message_fts_idx ON chats (message);
 /* CREATE INDEX IF NOT EXISTS chats_timestamp_idx ON chats (timestamp); ORDER BY can't be so slow pfft */
 
 CREATE TABLE IF NOT EXISTS subtitles (
   room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
   name VARCHAR(200) NOT NULL,
-	data MEDIUMTEXT NOT NULL,
+	data MEDIUMTEXT NOT NULL, /* normalised to WebVTT */
+	original_data MEDIUMTEXT NULL,
+	format VARCHAR(8) NOT NULL DEFAULT 'vtt', /* format of original_data: vtt, srt, ass, ttml */
+	language VARCHAR(35) NOT NULL DEFAULT '', /* BCP 47 language tag */
+	label VARCHAR(200) NOT NULL DEFAULT '',
+	uploader_id UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+	uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	cue_count INTEGER NOT NULL DEFAULT 0,
+	forced BOOLEAN NOT NULL DEFAULT FALSE,
+	sdh BOOLEAN NOT NULL DEFAULT FALSE,
+	time_offset DOUBLE PRECISION NOT NULL DEFAULT 0, /* seconds, added to the room's subtitle offset */
+	version INTEGER NOT NULL DEFAULT 1, /* latest version in subtitle_versions */
 	PRIMARY KEY (room_id, name));
 CREATE INDEX IF NOT EXISTS subtitles_room_id_idx ON subtitles (room_id);
 
+CREATE TABLE IF NOT EXISTS subtitle_versions (
+  room_id VARCHAR(24) NOT NULL,
+  name VARCHAR(200) NOT NULL,
+	version INTEGER NOT NULL,
+	data MEDIUMTEXT NOT NULL,
+	original_data MEDIUMTEXT NULL,
+	format VARCHAR(8) NOT NULL DEFAULT 'vtt',
+	uploader_id UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+	uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	cue_count INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (room_id, name, version),
+	FOREIGN KEY (room_id, name) REFERENCES subtitles(room_id, name) ON DELETE CASCADE ON UPDATE CASCADE);
+
+CREATE TABLE IF NOT EXISTS room_filters (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+	room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	pattern VARCHAR(200) NOT NULL,
+	is_regex BOOLEAN NOT NULL DEFAULT FALSE,
+	action VARCHAR(16) NOT NULL, /* mask, reject, flag */
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW());
+CREATE INDEX IF NOT EXISTS room_filters_room_id_idx ON room_filters (room_id);
+
+CREATE TABLE IF NOT EXISTS room_mutes (
+	room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (room_id, user_id));
+
+CREATE TABLE IF NOT EXISTS room_bans (
+	room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	moderator_id UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+	reason VARCHAR(200) NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NULL, /* NULL for permanent bans */
+	PRIMARY KEY (room_id, user_id));
+
+CREATE TABLE IF NOT EXISTS moderation_logs (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+	room_id VARCHAR(24) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	moderator_id UUID NULL REFERENCES users(id) ON DELETE SET NULL, /* NULL for automatic actions */
+	target_id UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+	action VARCHAR(24) NOT NULL,
+	details TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW());
+CREATE INDEX IF NOT EXISTS moderation_logs_room_id_idx ON moderation_logs (room_id);
+
 CREATE TABLE IF NOT EXISTS password_reset_tokens (
 	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
 	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
 	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW());
 
 COMMIT;`)); err != nil {
-		log.Fatalln("Failed to create tables and indexes!", err)
+		fatal("Failed to create tables and indexes!", "error", err)
 	}
 }
 
 func UpgradeSqlTables() {
-	log.Println("Upgrading database schema...")
+	slog.Info("Upgrading database schema...")
 	tokenFKeyName := "tokens_user_id_fkey"
 	if config.Database == "mysql" {
 		tokenFKeyName = "tokens_ibfk_1" // MySQL uses different names for foreign keys
@@ -94,8 +193,37 @@ ALTER TABLE users
 -- [#Postgres] ALTER TABLE rooms ALTER COLUMN target TYPE VARCHAR(1024);
 -- [#MySQL]    ALTER TABLE rooms MODIFY COLUMN target VARCHAR(1024) NOT NULL;
 
+-- Upgrading from concinnity 1.1.1
+ALTER TABLE rooms
+  ADD COLUMN IF NOT EXISTS owner_id UUID NULL DEFAULT NULL REFERENCES users(id) ON DELETE SET NULL,
+  ADD COLUMN IF NOT EXISTS slow_mode INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS subtitle_offset DOUBLE PRECISION NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS persistent BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ NULL DEFAULT NULL,
+  ADD COLUMN IF NOT EXISTS visibility VARCHAR(8) NOT NULL DEFAULT 'unlisted',
+  ADD COLUMN IF NOT EXISTS password VARCHAR(100) NULL DEFAULT NULL,
+  ADD COLUMN IF NOT EXISTS title VARCHAR(100) NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS description VARCHAR(1000) NOT NULL DEFAULT '';
+ALTER TABLE avatars ADD COLUMN IF NOT EXISTS animated BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE subtitles
+  ADD COLUMN IF NOT EXISTS original_data MEDIUMTEXT NULL,
+  ADD COLUMN IF NOT EXISTS format VARCHAR(8) NOT NULL DEFAULT 'vtt',
+  ADD COLUMN IF NOT EXISTS language VARCHAR(35) NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS label VARCHAR(200) NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS uploader_id UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+  ADD COLUMN IF NOT EXISTS uploaded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN IF NOT EXISTS cue_count INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS forced BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN IF NOT EXISTS sdh BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN IF NOT EXISTS time_offset DOUBLE PRECISION NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+INSERT INTO subtitle_versions (room_id, name, version, data, original_data, format, uploader_id, uploaded_at, cue_count)
+  SELECT room_id, name, version, data, original_data, format, uploader_id, uploaded_at, cue_count FROM subtitles
+  WHERE NOT EXISTS (SELECT 1 FROM subtitle_versions v
+    WHERE v.room_id = subtitles.room_id AND v.name = subtitles.name AND v.version = subtitles.version);
+
 COMMIT;`)); err != nil {
-		log.Fatalln("Failed to run database schema upgrade!", err)
+		fatal("Failed to run database schema upgrade!", "error", err)
 	}
 }
 
@@ -121,28 +249,91 @@ var (
 	deletePasswordResetTokenStmt        *sql.Stmt
 	purgeExpiredPasswordResetTokensStmt *sql.Stmt
 
-	findAvatarByHashStmt *sql.Stmt
-	insertAvatarStmt     *sql.Stmt
-	deleteAvatarStmt     *sql.Stmt
-
-	insertRoomStmt         *sql.Stmt
-	findRoomStmt           *sql.Stmt
-	findRoomModifyTimeStmt *sql.Stmt // MySQL specific, complementing updateRoomStmt
-	findInactiveRoomsStmt  *sql.Stmt
-	updateRoomStmt         *sql.Stmt
-	updateRoomModifiedStmt *sql.Stmt // MySQL specific, complementing insertChatMessageStmt
-	updateRoomStateStmt    *sql.Stmt
-	deleteRoomStmt         *sql.Stmt
-
-	findChatMessagesByRoomStmt *sql.Stmt
-	insertChatMessageStmt      *sql.Stmt
-
-	findSubtitlesByRoomStmt *sql.Stmt
-	findSubtitleStmt        *sql.Stmt
-	insertSubtitleStmt      *sql.Stmt
-	deleteRoomSubtitlesStmt *sql.Stmt // MySQL specific, complementing updateRoomStmt
+	findAvatarByHashStmt         *sql.Stmt
+	findAvatarAnimatedStmt       *sql.Stmt
+	insertAvatarStmt             *sql.Stmt
+	deleteOrphanedAvatarStmt     *sql.Stmt
+	findOrphanedAvatarsStmt      *sql.Stmt
+	findAvatarStorageStmt        *sql.Stmt
+	findAvatarVariantStorageStmt *sql.Stmt
+
+	findAvatarVariantStmt   *sql.Stmt
+	insertAvatarVariantStmt *sql.Stmt
+
+	insertRoomStmt               *sql.Stmt
+	findRoomStmt                 *sql.Stmt
+	findRoomModifyTimeStmt       *sql.Stmt // MySQL specific, complementing updateRoomStmt
+	findInactiveRoomsStmt        *sql.Stmt
+	findArchivableRoomsStmt      *sql.Stmt
+	findExpiredArchivedRoomsStmt *sql.Stmt
+	countPersistentRoomsStmt     *sql.Stmt
+	findPublicRoomsStmt          *sql.Stmt
+	findOwnedRoomsStmt           *sql.Stmt
+	findRecentRoomsStmt          *sql.Stmt
+	updateRoomStmt               *sql.Stmt
+	updateRoomModifiedStmt       *sql.Stmt // MySQL specific, complementing insertChatMessageStmt
+	updateRoomStateStmt          *sql.Stmt
+	updateRoomSlowModeStmt       *sql.Stmt
+	updateRoomSubtitleOffsetStmt *sql.Stmt
+	updateRoomPersistentStmt     *sql.Stmt
+	updateRoomVisibilityStmt     *sql.Stmt
+	updateRoomPasswordStmt       *sql.Stmt
+	updateRoomDetailsStmt        *sql.Stmt
+	archiveRoomStmt              *sql.Stmt
+	unarchiveRoomStmt            *sql.Stmt
+	deleteRoomStmt               *sql.Stmt
+
+	findChatMessagesByRoomStmt       *sql.Stmt
+	findChatMessagesAfterStmt        *sql.Stmt
+	insertChatMessageStmt            *sql.Stmt
+	findRecentChatMessagesByUserStmt *sql.Stmt
+	searchChatMessagesStmt           *sql.Stmt
+	deleteChatMessagesByUserStmt     *sql.Stmt
+
+	findRoomMemberStmt   *sql.Stmt
+	upsertRoomMemberStmt *sql.Stmt
+	deleteRoomMemberStmt *sql.Stmt
+
+	findRoomInvitesStmt  *sql.Stmt
+	insertRoomInviteStmt *sql.Stmt
+	useRoomInviteStmt    *sql.Stmt
+	deleteRoomInviteStmt *sql.Stmt
+
+	findRoomFiltersStmt  *sql.Stmt
+	insertRoomFilterStmt *sql.Stmt
+	deleteRoomFilterStmt *sql.Stmt
+
+	findRoomMutesStmt         *sql.Stmt
+	upsertRoomMuteStmt        *sql.Stmt
+	deleteRoomMuteStmt        *sql.Stmt
+	purgeExpiredRoomMutesStmt *sql.Stmt
+
+	findRoomBansStmt         *sql.Stmt
+	findRoomBanStmt          *sql.Stmt
+	upsertRoomBanStmt        *sql.Stmt
+	deleteRoomBanStmt        *sql.Stmt
+	purgeExpiredRoomBansStmt *sql.Stmt
+
+	insertModerationLogStmt *sql.Stmt
+	findModerationLogsStmt  *sql.Stmt
+
+	findSubtitlesByRoomStmt    *sql.Stmt
+	findSubtitleStmt           *sql.Stmt
+	findSubtitleMetadataStmt   *sql.Stmt
+	insertSubtitleStmt         *sql.Stmt
+	updateSubtitleMetadataStmt *sql.Stmt
+	updateSubtitleOffsetStmt   *sql.Stmt
+	findSubtitleVersionsStmt   *sql.Stmt
+	findSubtitleVersionStmt    *sql.Stmt
+	insertSubtitleVersionStmt  *sql.Stmt
+	purgeSubtitleVersionsStmt  *sql.Stmt
+	deleteSubtitleStmt         *sql.Stmt
+	deleteRoomSubtitlesStmt    *sql.Stmt // MySQL specific, complementing updateRoomStmt
 )
 
+// sqlStatementsPrepared is set once PrepareSqlStatements has prepared every statement above.
+var sqlStatementsPrepared atomic.Bool
+
 func PrepareSqlStatements() {
 	findUserByTokenStmt = prepareQuery("SELECT username, password, email, id, users.created_at " +
 		"AS user_created_at, verified, avatar, token, tokens.created_at AS token_created_at FROM tokens " +
@@ -178,21 +369,54 @@ func PrepareSqlStatements() {
 	deletePasswordResetTokenStmt = prepareQuery(
 		"DELETE FROM password_reset_tokens WHERE id = $1 RETURNING user_id, created_at;")
 	purgeExpiredPasswordResetTokensStmt = prepareQuery(
-		"DELETE FROM password_reset_tokens WHERE created_at < NOW() - INTERVAL '10 minutes';")
+		"DELETE FROM password_reset_tokens WHERE created_at < $1;")
 
-	findAvatarByHashStmt = prepareQuery("SELECT hash, data, created_at FROM avatars WHERE hash = $1;")
+	findAvatarByHashStmt = prepareQuery("SELECT hash, data, created_at, animated FROM avatars WHERE hash = $1;")
+	findAvatarAnimatedStmt = prepareQuery("SELECT animated FROM avatars WHERE hash = $1;")
+	// Re-uploading an existing avatar resets its age, so it isn't collected before it's used again
+	insertAvatarStmt = prepareQuery("INSERT INTO avatars (hash, data, animated) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (hash) DO UPDATE SET created_at = NOW();")
+	findOrphanedAvatarsStmt = prepareQuery("SELECT hash FROM avatars WHERE created_at < $1 " +
+		"AND NOT EXISTS (SELECT 1 FROM users WHERE users.avatar = avatars.hash);")
+	deleteOrphanedAvatarStmt = prepareQuery("DELETE FROM avatars WHERE hash = $1 AND created_at < $2 " +
+		"AND NOT EXISTS (SELECT 1 FROM users WHERE users.avatar = avatars.hash);")
+	findAvatarStorageStmt = prepareQuery("SELECT COUNT(*), COALESCE(SUM(LENGTH(data)), 0), " +
+		"COALESCE(SUM(CASE WHEN NOT EXISTS (SELECT 1 FROM users WHERE users.avatar = avatars.hash) " +
+		"THEN 1 ELSE 0 END), 0) FROM avatars;")
+	findAvatarVariantStorageStmt = prepareQuery("SELECT size, format, animated, COUNT(*), " +
+		"COALESCE(SUM(LENGTH(data)), 0) FROM avatar_variants GROUP BY size, format, animated " +
+		"ORDER BY size, format, animated;")
+
+	findAvatarVariantStmt = prepareQuery(
+		"SELECT data FROM avatar_variants WHERE hash = $1 AND size = $2 AND format = $3 AND animated = $4;")
 	if config.Database == "mysql" {
-		insertAvatarStmt = prepareQuery("INSERT IGNORE INTO avatars (hash, data) VALUES (?, ?);")
+		insertAvatarVariantStmt = prepareQuery(
+			"INSERT IGNORE INTO avatar_variants (hash, size, format, animated, data) VALUES (?, ?, ?, ?, ?);")
 	} else {
-		insertAvatarStmt = prepareQuery("INSERT INTO avatars (hash, data) VALUES ($1, $2) ON CONFLICT (hash) DO NOTHING;")
+		insertAvatarVariantStmt = prepareQuery("INSERT INTO avatar_variants (hash, size, format, animated, data) " +
+			"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (hash, size, format, animated) DO NOTHING;")
 	}
-	deleteAvatarStmt = prepareQuery("DELETE FROM avatars WHERE hash = $1;")
 
-	insertRoomStmt = prepareQuery("INSERT INTO rooms (id, type, target) " +
-		"VALUES ($1, $2, $3);")
+	insertRoomStmt = prepareQuery("INSERT INTO rooms " +
+		"(id, type, target, owner_id, persistent, visibility, password, title, description) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);")
 	findRoomStmt = prepareQuery("SELECT id, created_at, modified_at, type, target, " +
-		"paused, speed, timestamp, last_action FROM rooms WHERE id = $1;")
-	findInactiveRoomsStmt = prepareQuery("SELECT id FROM rooms WHERE modified_at < NOW() - INTERVAL '10 minutes';")
+		"paused, speed, timestamp, last_action, owner_id, slow_mode, subtitle_offset, " +
+		"persistent, archived_at, visibility, password, title, description FROM rooms WHERE id = $1;")
+	findInactiveRoomsStmt = prepareQuery("SELECT id FROM rooms WHERE NOT persistent AND modified_at < $1;")
+	findArchivableRoomsStmt = prepareQuery(
+		"SELECT id FROM rooms WHERE persistent AND archived_at IS NULL AND modified_at < $1;")
+	findExpiredArchivedRoomsStmt = prepareQuery("SELECT id FROM rooms WHERE archived_at < $1;")
+	countPersistentRoomsStmt = prepareQuery("SELECT COUNT(*) FROM rooms WHERE owner_id = $1 AND persistent;")
+	findPublicRoomsStmt = prepareQuery("SELECT id, title, description, type, visibility, paused, created_at, " +
+		"modified_at FROM rooms WHERE visibility = 'public' AND archived_at IS NULL " +
+		"AND (LOWER(title) LIKE $1 OR LOWER(description) LIKE $2) ORDER BY created_at DESC LIMIT " +
+		strconv.Itoa(maxPublicRoomListings+1) + ";") // One extra row shows whether the list is truncated
+	findOwnedRoomsStmt = prepareQuery("SELECT id, title, description, type, visibility, paused, created_at, " +
+		"modified_at FROM rooms WHERE owner_id = $1 ORDER BY modified_at DESC LIMIT 50;")
+	findRecentRoomsStmt = prepareQuery("SELECT r.id, r.title, r.description, r.type, r.visibility, r.paused, " +
+		"r.created_at, r.modified_at, m.joined_at FROM room_members m JOIN rooms r ON r.id = m.room_id " +
+		"WHERE m.user_id = $1 ORDER BY m.joined_at DESC LIMIT 20;")
 	if config.Database == "mysql" {
 		deleteRoomSubtitlesStmt = prepareQuery("DELETE FROM subtitles WHERE room_id = ?;")
 		updateRoomStmt = prepareQuery(`UPDATE rooms
@@ -203,7 +427,7 @@ func PrepareSqlStatements() {
 	} else {
 		updateRoomStmt = prepareQuery(`
 			WITH subs AS (
-				DELETE FROM subtitles WHERE room_id = $1
+				DELETE FROM subtitles WHERE room_id = $1 AND NOT $4::BOOLEAN
 			) UPDATE rooms
   			SET type = $2, target = $3, modified_at = NOW(),
 						paused = true, speed = 1, timestamp = 0, last_action = NOW()
@@ -212,9 +436,20 @@ func PrepareSqlStatements() {
 	}
 	updateRoomStateStmt = prepareQuery("UPDATE rooms SET " +
 		"paused = $2, speed = $3, timestamp = $4, last_action = $5, modified_at = NOW() WHERE id = $1;")
+	updateRoomSlowModeStmt = prepareQuery("UPDATE rooms SET slow_mode = $1 WHERE id = $2;")
+	updateRoomSubtitleOffsetStmt = prepareQuery("UPDATE rooms SET subtitle_offset = $1 WHERE id = $2;")
+	updateRoomPersistentStmt = prepareQuery("UPDATE rooms SET persistent = $1 WHERE id = $2;")
+	updateRoomVisibilityStmt = prepareQuery("UPDATE rooms SET visibility = $1 WHERE id = $2;")
+	updateRoomPasswordStmt = prepareQuery("UPDATE rooms SET password = $1 WHERE id = $2;")
+	updateRoomDetailsStmt = prepareQuery("UPDATE rooms SET title = $1, description = $2 WHERE id = $3;")
+	archiveRoomStmt = prepareQuery("UPDATE rooms SET archived_at = NOW() WHERE id = $1;")
+	unarchiveRoomStmt = prepareQuery("UPDATE rooms SET archived_at = NULL, modified_at = NOW() WHERE id = $1;")
 	deleteRoomStmt = prepareQuery("DELETE FROM rooms WHERE id = $1;")
 
-	findChatMessagesByRoomStmt = prepareQuery("SELECT id, user_id, timestamp, message FROM chats WHERE room_id = $1;")
+	findChatMessagesByRoomStmt = prepareQuery(
+		"SELECT id, user_id, timestamp, message FROM chats WHERE room_id = $1 ORDER BY id;")
+	findChatMessagesAfterStmt = prepareQuery("SELECT id, user_id, timestamp, message FROM chats " +
+		"WHERE room_id = $1 AND id > $2 ORDER BY id LIMIT $3;")
 	if config.Database == "mysql" {
 		updateRoomModifiedStmt = prepareQuery("UPDATE rooms SET modified_at = NOW() WHERE id = ?;")
 		insertChatMessageStmt = prepareQuery(
@@ -226,12 +461,96 @@ func PrepareSqlStatements() {
 			) INSERT INTO chats (room_id, user_id, message) VALUES ($1, $2, $3) RETURNING id, timestamp;`)
 	}
 
-	findSubtitlesByRoomStmt = prepareQuery("SELECT name FROM subtitles WHERE room_id = $1;")
-	findSubtitleStmt = prepareQuery("SELECT data FROM subtitles WHERE room_id = $1 AND name = $2;")
+	if config.Database == "mysql" {
+		searchChatMessagesStmt = prepareQuery(`SELECT id, user_id, timestamp, message FROM chats
+			WHERE room_id = $1 AND MATCH (message) AGAINST ($2 IN BOOLEAN MODE)
+				AND ($3 IS NULL OR user_id = $3) AND ($4 IS NULL OR timestamp >= $4) AND ($5 IS NULL OR timestamp <= $5)
+			ORDER BY id DESC LIMIT $6 OFFSET $7;`)
+	} else {
+		searchChatMessagesStmt = prepareQuery(`SELECT id, user_id, timestamp, message FROM chats
+			WHERE room_id = $1 AND to_tsvector('simple', message) @@ to_tsquery('simple', $2)
+				AND ($3::UUID IS NULL OR user_id = $3)
+				AND ($4::TIMESTAMPTZ IS NULL OR timestamp >= $4) AND ($5::TIMESTAMPTZ IS NULL OR timestamp <= $5)
+			ORDER BY id DESC LIMIT $6 OFFSET $7;`)
+	}
+	findRecentChatMessagesByUserStmt = prepareQuery(
+		"SELECT id FROM chats WHERE room_id = $1 AND user_id = $2 ORDER BY id DESC LIMIT $3;")
+	deleteChatMessagesByUserStmt = prepareQuery(
+		"DELETE FROM chats WHERE room_id = $1 AND user_id = $2 AND id >= $3 AND id <= $4;")
+
+	findRoomMemberStmt = prepareQuery("SELECT COUNT(*) FROM room_members WHERE room_id = $1 AND user_id = $2;")
+	upsertRoomMemberStmt = prepareQuery("INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) " +
+		"ON CONFLICT (room_id, user_id) DO UPDATE SET joined_at = NOW();")
+	deleteRoomMemberStmt = prepareQuery("DELETE FROM room_members WHERE room_id = $1 AND user_id = $2;")
+
+	findRoomInvitesStmt = prepareQuery("SELECT id, creator_id, created_at, expires_at, max_uses, uses " +
+		"FROM room_invites WHERE room_id = $1 ORDER BY created_at;")
+	insertRoomInviteStmt = prepareQuery("INSERT INTO room_invites (id, room_id, creator_id, expires_at, max_uses) " +
+		"VALUES ($1, $2, $3, $4, $5) RETURNING created_at;")
+	useRoomInviteStmt = prepareQuery("UPDATE room_invites SET uses = uses + 1 WHERE id = $1 AND room_id = $2 " +
+		"AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > NOW());")
+	deleteRoomInviteStmt = prepareQuery("DELETE FROM room_invites WHERE id = $1 AND room_id = $2;")
+
+	findRoomFiltersStmt = prepareQuery(
+		"SELECT id, pattern, is_regex, action FROM room_filters WHERE room_id = $1 ORDER BY id;")
+	insertRoomFilterStmt = prepareQuery(
+		"INSERT INTO room_filters (room_id, pattern, is_regex, action) VALUES ($1, $2, $3, $4) RETURNING id;")
+	deleteRoomFilterStmt = prepareQuery("DELETE FROM room_filters WHERE id = $1 AND room_id = $2;")
+
+	findRoomMutesStmt = prepareQuery(
+		"SELECT user_id, expires_at FROM room_mutes WHERE room_id = $1 AND expires_at > NOW();")
+	upsertRoomMuteStmt = prepareQuery(`
+		INSERT INTO room_mutes (room_id, user_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET expires_at = $3;`)
+	deleteRoomMuteStmt = prepareQuery("DELETE FROM room_mutes WHERE room_id = $1 AND user_id = $2;")
+	purgeExpiredRoomMutesStmt = prepareQuery("DELETE FROM room_mutes WHERE expires_at < NOW();")
+
+	findRoomBansStmt = prepareQuery("SELECT user_id, moderator_id, reason, created_at, expires_at " +
+		"FROM room_bans WHERE room_id = $1 AND (expires_at IS NULL OR expires_at > NOW()) ORDER BY created_at DESC;")
+	findRoomBanStmt = prepareQuery("SELECT user_id, moderator_id, reason, created_at, expires_at " +
+		"FROM room_bans WHERE room_id = $1 AND user_id = $2 AND (expires_at IS NULL OR expires_at > NOW());")
+	upsertRoomBanStmt = prepareQuery(`
+		INSERT INTO room_bans (room_id, user_id, moderator_id, reason, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET moderator_id = $3, reason = $4, created_at = NOW(),
+		expires_at = $5;`)
+	deleteRoomBanStmt = prepareQuery("DELETE FROM room_bans WHERE room_id = $1 AND user_id = $2 " +
+		"AND (expires_at IS NULL OR expires_at > NOW());")
+	purgeExpiredRoomBansStmt = prepareQuery("DELETE FROM room_bans WHERE expires_at < NOW();")
+
+	insertModerationLogStmt = prepareQuery("INSERT INTO moderation_logs " +
+		"(room_id, moderator_id, target_id, action, details) VALUES ($1, $2, $3, $4, $5);")
+	findModerationLogsStmt = prepareQuery("SELECT id, moderator_id, target_id, action, details, created_at " +
+		"FROM moderation_logs WHERE room_id = $1 ORDER BY id DESC LIMIT 100;")
+
+	findSubtitlesByRoomStmt = prepareQuery("SELECT name, language, label, uploader_id, uploaded_at, " +
+		"cue_count, forced, sdh, time_offset, version FROM subtitles WHERE room_id = $1 ORDER BY name;")
+	findSubtitleStmt = prepareQuery(
+		"SELECT data, original_data, format FROM subtitles WHERE room_id = $1 AND name = $2;")
+	findSubtitleMetadataStmt = prepareQuery("SELECT name, language, label, uploader_id, uploaded_at, " +
+		"cue_count, forced, sdh, time_offset, version FROM subtitles WHERE room_id = $1 AND name = $2;")
 	insertSubtitleStmt = prepareQuery(`
-		INSERT INTO subtitles (room_id, name, data) VALUES ($1, $2, $3)
-  	ON CONFLICT (room_id, name) DO UPDATE SET data = $3;
+		INSERT INTO subtitles (room_id, name, data, original_data, format,
+			language, label, uploader_id, cue_count, forced, sdh)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+  	ON CONFLICT (room_id, name) DO UPDATE SET data = $3, original_data = $4, format = $5,
+			language = $6, label = $7, uploader_id = $8, uploaded_at = NOW(), cue_count = $9, forced = $10, sdh = $11,
+			version = subtitles.version + 1
+		RETURNING uploaded_at, version;
 	`)
+	updateSubtitleMetadataStmt = prepareQuery("UPDATE subtitles SET " +
+		"name = $1, language = $2, label = $3, forced = $4, sdh = $5 WHERE room_id = $6 AND name = $7;")
+	updateSubtitleOffsetStmt = prepareQuery(
+		"UPDATE subtitles SET time_offset = $1 WHERE room_id = $2 AND name = $3;")
+	deleteSubtitleStmt = prepareQuery("DELETE FROM subtitles WHERE room_id = $1 AND name = $2;")
+	findSubtitleVersionsStmt = prepareQuery("SELECT version, format, uploader_id, uploaded_at, cue_count " +
+		"FROM subtitle_versions WHERE room_id = $1 AND name = $2 ORDER BY version DESC;")
+	findSubtitleVersionStmt = prepareQuery("SELECT data, original_data, format, cue_count " +
+		"FROM subtitle_versions WHERE room_id = $1 AND name = $2 AND version = $3;")
+	insertSubtitleVersionStmt = prepareQuery("INSERT INTO subtitle_versions (room_id, name, version, " +
+		"data, original_data, format, uploader_id, uploaded_at, cue_count) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);")
+	purgeSubtitleVersionsStmt = prepareQuery(
+		"DELETE FROM subtitle_versions WHERE room_id = $1 AND name = $2 AND version <= $3;")
+	sqlStatementsPrepared.Store(true)
 }
 
 func translate(query string) string {
@@ -259,21 +578,133 @@ func prepareQuery(query string) *sql.Stmt {
 	query = translate(query)
 	stmt, err := db.Prepare(query)
 	if err != nil {
-		log.Fatalln("failed to build SQL query:", query, err)
+		fatal("Failed to build SQL query!", "query", query, "error", err)
 	}
 	return stmt
 }
 
-func UpdateRoom(id string, roomType string, target string) (createdAt, modifiedAt time.Time, err error) {
+func FindRoom(id string) (room Room, err error) {
+	err = findRoomStmt.QueryRow(id).Scan(
+		&room.ID, &room.CreatedAt, &room.ModifiedAt, &room.Type, &room.Target,
+		&room.Paused, &room.Speed, &room.Timestamp, &room.LastAction, &room.OwnerID,
+		&room.SlowMode, &room.SubtitleOffset, &room.Persistent, &room.ArchivedAt, &room.Visibility,
+		&room.Password, &room.Title, &room.Description)
+	room.HasPassword = room.Password != nil
+	return
+}
+
+// FindRoomListings returns the rooms found by a statement which selects room listing columns, with
+// an optional extra column for when the user last joined each room.
+func FindRoomListings(stmt *sql.Stmt, withJoinedAt bool, args ...any) ([]RoomListing, error) {
+	listings := make([]RoomListing, 0)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memberCounts := CountAllRoomMembers()
+	for rows.Next() {
+		var listing RoomListing
+		dest := []any{&listing.ID, &listing.Title, &listing.Description, &listing.Type, &listing.Visibility,
+			&listing.Paused, &listing.CreatedAt, &listing.ModifiedAt}
+		if withJoinedAt {
+			dest = append(dest, &listing.JoinedAt)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		listing.MemberCount = memberCounts[listing.ID]
+		listings = append(listings, listing)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+// IsRoomMember returns whether a user has joined a room or redeemed an invite to it before.
+func IsRoomMember(roomId string, userId uuid.UUID) (bool, error) {
+	var count int
+	err := findRoomMemberStmt.QueryRow(roomId, userId).Scan(&count)
+	return count > 0, err
+}
+
+func FindRoomInvites(roomId string) ([]RoomInvite, error) {
+	invites := make([]RoomInvite, 0)
+	rows, err := findRoomInvitesStmt.Query(roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var invite RoomInvite
+		err = rows.Scan(&invite.ID, &invite.CreatorID, &invite.CreatedAt, &invite.ExpiresAt,
+			&invite.MaxUses, &invite.Uses)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func FindUserProfiles(ids []uuid.UUID) (map[uuid.UUID]UserProfile, error) {
+	profiles := make(map[uuid.UUID]UserProfile)
+	if len(ids) == 0 {
+		return profiles, nil
+	}
+	idStrings := make([]string, len(ids))
+	for i, id := range ids {
+		idStrings[i] = id.String()
+	}
+	var rows *sql.Rows
+	var err error
+	if config.Database == "mysql" {
+		placeholders := strings.Repeat("?,", len(ids))
+		placeholders = placeholders[:len(placeholders)-1]
+		mysqlArr := make([]interface{}, len(ids))
+		for i, id := range idStrings {
+			mysqlArr[i] = id
+		}
+		rows, err = db.Query("SELECT id, username, avatar FROM users WHERE id IN ("+placeholders+");", mysqlArr...)
+	} else {
+		rows, err = findUserProfilesByIdStmt.Query(pq.Array(idStrings))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uuid.UUID
+		var userProfile UserProfile
+		if err = rows.Scan(&id, &userProfile.Username, &userProfile.Avatar); err != nil {
+			return nil, err
+		}
+		profiles[id] = userProfile
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func UpdateRoom(
+	id string, roomType string, target string, keepSubtitles bool,
+) (createdAt, modifiedAt time.Time, err error) {
 	if config.Database == "mysql" {
 		tx, err := db.Begin()
 		if err != nil {
 			return createdAt, modifiedAt, err
 		}
 		defer tx.Rollback()
-		_, err = tx.Stmt(deleteRoomSubtitlesStmt).Exec(id)
-		if err != nil {
-			return createdAt, modifiedAt, err
+		if !keepSubtitles {
+			_, err = tx.Stmt(deleteRoomSubtitlesStmt).Exec(id)
+			if err != nil {
+				return createdAt, modifiedAt, err
+			}
 		}
 		result, err := tx.Stmt(updateRoomStmt).Exec(roomType, target, id)
 		if err != nil {
@@ -294,10 +725,30 @@ func UpdateRoom(id string, roomType string, target string) (createdAt, modifiedA
 		}
 		return createdAt, modifiedAt, err
 	}
-	err = updateRoomStmt.QueryRow(id, roomType, target).Scan(&createdAt, &modifiedAt)
+	err = updateRoomStmt.QueryRow(id, roomType, target, keepSubtitles).Scan(&createdAt, &modifiedAt)
 	return
 }
 
+func UpdateRoomState(id string, state PlayerStateMessageData) error {
+	var result sql.Result
+	var err error
+	if config.Database == "mysql" {
+		result, err = updateRoomStateStmt.Exec(
+			state.Paused, state.Speed, state.Timestamp, state.LastAction, id)
+	} else {
+		result, err = updateRoomStateStmt.Exec(
+			id, state.Paused, state.Speed, state.Timestamp, state.LastAction)
+	}
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func FindChatMessagesByRoom(id string) ([]ChatMessage, error) {
 	chat := make([]ChatMessage, 0)
 	chatRows, err := findChatMessagesByRoomStmt.Query(id)
@@ -310,6 +761,7 @@ func FindChatMessagesByRoom(id string) ([]ChatMessage, error) {
 		if err = chatRows.Scan(&msg.ID, &msg.UserID, &msg.Timestamp, &msg.Message); err != nil {
 			return nil, err
 		}
+		msg.splitSubject()
 		chat = append(chat, msg)
 	}
 	if err = chatRows.Err(); err != nil {
@@ -318,6 +770,44 @@ func FindChatMessagesByRoom(id string) ([]ChatMessage, error) {
 	return chat, nil
 }
 
+// StreamChatMessagesByRoom calls fn with batches of up to batchSize messages from a room in order,
+// without loading the entire chat history into memory at once. Each batch is queried separately, so
+// no database connection is held while fn runs.
+func StreamChatMessagesByRoom(id string, batchSize int, fn func(batch []ChatMessage) error) error {
+	lastId := 0
+	for {
+		batch, err := findChatMessagesAfter(id, lastId, batchSize)
+		if err != nil {
+			return err
+		} else if len(batch) == 0 {
+			return nil
+		} else if err = fn(batch); err != nil {
+			return err
+		} else if len(batch) < batchSize {
+			return nil
+		}
+		lastId = batch[len(batch)-1].ID
+	}
+}
+
+func findChatMessagesAfter(id string, lastId int, limit int) ([]ChatMessage, error) {
+	chatRows, err := findChatMessagesAfterStmt.Query(id, lastId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer chatRows.Close()
+	batch := make([]ChatMessage, 0, limit)
+	for chatRows.Next() {
+		msg := ChatMessage{}
+		if err = chatRows.Scan(&msg.ID, &msg.UserID, &msg.Timestamp, &msg.Message); err != nil {
+			return nil, err
+		}
+		msg.splitSubject()
+		batch = append(batch, msg)
+	}
+	return batch, chatRows.Err()
+}
+
 func InsertChatMessage(roomId string, userId *uuid.UUID, message string) (id int, timestamp time.Time, err error) {
 	if config.Database == "mysql" {
 		tx, err := db.Begin()
@@ -342,22 +832,273 @@ func InsertChatMessage(roomId string, userId *uuid.UUID, message string) (id int
 	return
 }
 
-func FindSubtitlesByRoom(roomId string) ([]string, error) {
-	names := make([]string, 0)
-	nameRows, err := findSubtitlesByRoomStmt.Query(roomId)
+// SearchChatMessages finds messages in a room containing all the given search terms as word
+// prefixes, most recent first. Terms must consist of letters and digits only.
+func SearchChatMessages(
+	roomId string, terms []string, author uuid.NullUUID, from sql.NullTime, to sql.NullTime, limit int, offset int,
+) ([]ChatMessage, error) {
+	var rows *sql.Rows
+	var err error
+	if config.Database == "mysql" {
+		// Note: InnoDB ignores words shorter than innodb_ft_min_token_size (3 by default) and stopwords.
+		query := "+" + strings.Join(terms, "* +") + "*"
+		rows, err = searchChatMessagesStmt.Query(roomId, query,
+			author, author, from, from, to, to, limit, offset)
+	} else {
+		query := strings.Join(terms, ":* & ") + ":*"
+		rows, err = searchChatMessagesStmt.Query(roomId, query, author, from, to, limit, offset)
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer nameRows.Close()
-	for nameRows.Next() {
-		var name string
-		if err = nameRows.Scan(&name); err != nil {
+	defer rows.Close()
+	chat := make([]ChatMessage, 0)
+	for rows.Next() {
+		msg := ChatMessage{}
+		if err = rows.Scan(&msg.ID, &msg.UserID, &msg.Timestamp, &msg.Message); err != nil {
+			return nil, err
+		}
+		msg.splitSubject()
+		chat = append(chat, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
+
+// PurgeChatMessages deletes up to count of a user's most recent messages in a room, returning the
+// IDs of the deleted messages.
+func PurgeChatMessages(roomId string, userId uuid.UUID, count int) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	ids := make([]int, 0)
+	rows, err := tx.Stmt(findRecentChatMessagesByUserStmt).Query(roomId, userId, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	} else if len(ids) == 0 {
+		return ids, nil
+	}
+	rows.Close() // Must be closed before executing another statement on MySQL
+	_, err = tx.Stmt(deleteChatMessagesByUserStmt).Exec(roomId, userId, ids[len(ids)-1], ids[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func FindRoomFilters(roomId string) ([]ChatFilter, error) {
+	filters := make([]ChatFilter, 0)
+	rows, err := findRoomFiltersStmt.Query(roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filter ChatFilter
+		if err = rows.Scan(&filter.ID, &filter.Pattern, &filter.Regex, &filter.Action); err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+func FindRoomMutes(roomId string) (map[uuid.UUID]time.Time, error) {
+	mutes := make(map[uuid.UUID]time.Time)
+	rows, err := findRoomMutesStmt.Query(roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId uuid.UUID
+		var expiresAt time.Time
+		if err = rows.Scan(&userId, &expiresAt); err != nil {
+			return nil, err
+		}
+		mutes[userId] = expiresAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return mutes, nil
+}
+
+func UpsertRoomMute(roomId string, userId uuid.UUID, expiresAt time.Time) (err error) {
+	if config.Database == "mysql" {
+		_, err = upsertRoomMuteStmt.Exec(roomId, userId, expiresAt, expiresAt)
+	} else {
+		_, err = upsertRoomMuteStmt.Exec(roomId, userId, expiresAt)
+	}
+	return
+}
+
+// FindRoomBan returns a user's active ban from a room, or sql.ErrNoRows if they are not banned.
+func FindRoomBan(roomId string, userId uuid.UUID) (RoomBan, error) {
+	var ban RoomBan
+	err := findRoomBanStmt.QueryRow(roomId, userId).Scan(
+		&ban.UserID, &ban.ModeratorID, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt)
+	return ban, err
+}
+
+func FindRoomBans(roomId string) ([]RoomBan, error) {
+	bans := make([]RoomBan, 0)
+	rows, err := findRoomBansStmt.Query(roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ban RoomBan
+		if err = rows.Scan(&ban.UserID, &ban.ModeratorID, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func UpsertRoomBan(
+	roomId string, userId uuid.UUID, moderatorId uuid.UUID, reason string, expiresAt *time.Time,
+) (err error) {
+	if config.Database == "mysql" {
+		_, err = upsertRoomBanStmt.Exec(roomId, userId, moderatorId, reason, expiresAt, moderatorId, reason, expiresAt)
+	} else {
+		_, err = upsertRoomBanStmt.Exec(roomId, userId, moderatorId, reason, expiresAt)
+	}
+	return
+}
+
+func InsertModerationLog(
+	roomId string, moderatorId *uuid.UUID, targetId *uuid.UUID, action string, details string,
+) error {
+	_, err := insertModerationLogStmt.Exec(roomId, moderatorId, targetId, action, details)
+	return err
+}
+
+func FindModerationLogs(roomId string) ([]ModerationLog, error) {
+	logs := make([]ModerationLog, 0)
+	rows, err := findModerationLogsStmt.Query(roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry ModerationLog
+		if err = rows.Scan(&entry.ID, &entry.ModeratorID, &entry.TargetID,
+			&entry.Action, &entry.Details, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		logs = append(logs, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// UpsertSubtitle saves a subtitle as a new version, creating it if it doesn't exist. The upload
+// time and version of the metadata are set to those of the new version.
+func UpsertSubtitle(roomId string, metadata *SubtitleMetadata, data string, originalData string, format string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	args := []interface{}{roomId, metadata.Name, data, originalData, format, metadata.Language,
+		metadata.Label, metadata.UploaderID, metadata.CueCount, metadata.Forced, metadata.SDH}
+	if config.Database == "mysql" {
+		args = append(args, args[2:]...)
+	}
+	err = tx.Stmt(insertSubtitleStmt).QueryRow(args...).Scan(&metadata.UploadedAt, &metadata.Version)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(insertSubtitleVersionStmt).Exec(roomId, metadata.Name, metadata.Version,
+		data, originalData, format, metadata.UploaderID, metadata.UploadedAt, metadata.CueCount)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(purgeSubtitleVersionsStmt).Exec(roomId, metadata.Name, metadata.Version-maxSubtitleVersions)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func FindSubtitleVersions(roomId string, name string) ([]SubtitleVersion, error) {
+	versions := make([]SubtitleVersion, 0)
+	rows, err := findSubtitleVersionsStmt.Query(roomId, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version SubtitleVersion
+		err = rows.Scan(&version.Version, &version.Format, &version.UploaderID, &version.UploadedAt,
+			&version.CueCount)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func scanSubtitleMetadata(row interface{ Scan(...any) error }) (metadata SubtitleMetadata, err error) {
+	err = row.Scan(&metadata.Name, &metadata.Language, &metadata.Label, &metadata.UploaderID,
+		&metadata.UploadedAt, &metadata.CueCount, &metadata.Forced, &metadata.SDH, &metadata.Offset,
+		&metadata.Version)
+	return
+}
+
+func FindSubtitleMetadata(roomId string, name string) (SubtitleMetadata, error) {
+	return scanSubtitleMetadata(findSubtitleMetadataStmt.QueryRow(roomId, name))
+}
+
+func FindSubtitlesByRoom(roomId string) ([]SubtitleMetadata, error) {
+	subtitles := make([]SubtitleMetadata, 0)
+	rows, err := findSubtitlesByRoomStmt.Query(roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		metadata, err := scanSubtitleMetadata(rows)
+		if err != nil {
 			return nil, err
 		}
-		names = append(names, name)
+		subtitles = append(subtitles, metadata)
 	}
-	if err = nameRows.Err(); err != nil {
+	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return names, nil
+	return subtitles, nil
 }
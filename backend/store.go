@@ -1,7 +1,10 @@
 package main
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
 	"os"
 	"time"
 
@@ -27,6 +30,82 @@ type UserConns = *xsync.MapOf[chan<- interface{}, UserConnInfo]
 
 var userConns *xsync.MapOf[uuid.UUID, UserConns] = xsync.NewMapOf[uuid.UUID, UserConns]()
 
+type RoomNicknames = *xsync.MapOf[uuid.UUID, string]
+
+var roomNicknames *xsync.MapOf[string, RoomNicknames] = xsync.NewMapOf[string, RoomNicknames]()
+
+func SetRoomNickname(roomId string, userId uuid.UUID, nickname string) {
+	nicknames, _ := roomNicknames.LoadOrStore(roomId, xsync.NewMapOf[uuid.UUID, string]())
+	if nickname == "" {
+		nicknames.Delete(userId)
+	} else {
+		nicknames.Store(userId, nickname)
+	}
+}
+
+var roomSlowModes *xsync.MapOf[string, time.Duration] = xsync.NewMapOf[string, time.Duration]()
+
+var roomLastMessages *xsync.MapOf[string, *xsync.MapOf[uuid.UUID, time.Time]] = xsync.NewMapOf[string, *xsync.MapOf[uuid.UUID, time.Time]]()
+
+// CheckSlowMode records a chat message from a user if the room's slow mode allows it, otherwise it
+// returns how long the user must wait before sending another message.
+func CheckSlowMode(roomId string, userId uuid.UUID) time.Duration {
+	slowMode, ok := roomSlowModes.Load(roomId)
+	if !ok || slowMode <= 0 {
+		return 0
+	}
+	var wait time.Duration
+	lastMessages, _ := roomLastMessages.LoadOrStore(roomId, xsync.NewMapOf[uuid.UUID, time.Time]())
+	lastMessages.Compute(userId, func(last time.Time, loaded bool) (time.Time, bool) {
+		now := time.Now()
+		if loaded && now.Sub(last) < slowMode {
+			wait = slowMode - now.Sub(last)
+			return last, false
+		}
+		return now, false
+	})
+	return wait
+}
+
+// CountRoomMembers returns the number of users currently connected to a room.
+func CountRoomMembers(roomId string) int {
+	members, ok := roomMembers.Load(roomId)
+	if !ok {
+		return 0
+	}
+	users := make(map[uuid.UUID]bool)
+	members.Range(func(connId RoomConnID, _ chan<- interface{}) bool {
+		users[connId.UserID] = true
+		return true
+	})
+	return len(users)
+}
+
+// CountAllRoomMembers returns the number of unique users connected to each room with any, counted in
+// one pass, for listing many rooms at once.
+func CountAllRoomMembers() map[string]int {
+	counts := make(map[string]int)
+	roomMembers.Range(func(roomId string, members RoomMembers) bool {
+		users := make(map[uuid.UUID]bool)
+		members.Range(func(connId RoomConnID, _ chan<- interface{}) bool {
+			users[connId.UserID] = true
+			return true
+		})
+		counts[roomId] = len(users)
+		return true
+	})
+	return counts
+}
+
+// CanAccessRoom returns whether a user can join a room and view its contents without a password
+// or invite, which is the case for its members and for public or unlisted rooms without a password.
+func CanAccessRoom(room *Room, userId uuid.UUID) (bool, error) {
+	if room.IsModerator(userId) || (room.Visibility != RoomVisibilityPrivate && room.Password == nil) {
+		return true, nil
+	}
+	return IsRoomMember(room.ID, userId)
+}
+
 func RegisterConnection(
 	roomId string, connId RoomConnID, userToken string, writeChannel chan<- interface{},
 ) (members RoomMembers, previousConnectionExisted bool) {
@@ -38,8 +117,8 @@ func RegisterConnection(
 	connections, _ := userConns.LoadOrStore(connId.UserID, xsync.NewMapOf[chan<- interface{}, UserConnInfo]())
 	connections.Store(writeChannel, UserConnInfo{RoomID: roomId, Token: userToken})
 	if os.Getenv("CONCINNITY_DEBUG_CONNECTIONS") == "true" {
-		log.Printf("C: Client ID: %s | Room %s members: %v\n", connId.ClientID, roomId, members.Size())
-		log.Printf("C: Client ID: %s | User connections: %v\n", connId.ClientID, connections.Size())
+		slog.Info("Client connected", "client_id", connId.ClientID, "room_id", roomId,
+			"room_members", members.Size(), "user_connections", connections.Size())
 	}
 	return members, previousConnectionExisted
 }
@@ -50,7 +129,7 @@ func UnregisterConnection(
 	userConns.Compute(connId.UserID, func(value UserConns, loaded bool) (UserConns, bool) {
 		value.Delete(writeChannel)
 		if os.Getenv("CONCINNITY_DEBUG_CONNECTIONS") == "true" {
-			log.Printf("DC: Client ID: %s | User connections: %v\n", connId.ClientID, value.Size())
+			slog.Info("Client disconnected", "client_id", connId.ClientID, "user_connections", value.Size())
 		}
 		return value, value.Size() == 0 // Delete user if no connections left
 	})
@@ -60,48 +139,115 @@ func UnregisterConnection(
 			if value == writeChannel {
 				size--
 			}
-			log.Printf("DC: Client ID: %s | Room %s members: %v\n", connId.ClientID, roomId, size)
+			slog.Info("Client disconnected", "client_id", connId.ClientID, "room_id", roomId, "room_members", size)
 		}
 		return value, value == writeChannel // Delete only if this is the current i.e. right connection
 	})
 }
 
-func PurgeExpiredDataTask() {
+// PurgeExpiredDataTask cleans up expired data every 10 minutes until ctx is cancelled. A run which
+// has already started is finished first.
+func PurgeExpiredDataTask(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(10 * time.Minute)
-		if _, err := purgeExpiredPasswordResetTokensStmt.Exec(); err != nil {
-			log.Println("Failed to purge expired password reset tokens!", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		runBackgroundTask("purge_password_reset_tokens", func() error {
+			_, err := purgeExpiredPasswordResetTokensStmt.Exec(
+				time.Now().Add(-time.Duration(config.Limits.PasswordResetTTL) * time.Minute))
+			return err
+		})
+		runBackgroundTask("purge_room_mutes", func() error {
+			_, err := purgeExpiredRoomMutesStmt.Exec()
+			return err
+		})
+		runBackgroundTask("purge_room_bans", func() error {
+			_, err := purgeExpiredRoomBansStmt.Exec()
+			return err
+		})
+		runBackgroundTask("clean_inactive_rooms", CleanInactiveRooms)
+		runBackgroundTask("clean_rate_limits", func() error {
+			CleanIdleRateLimits()
+			return nil
+		})
+		runBackgroundTask("collect_orphaned_avatars", CollectOrphanedAvatars)
+	}
+}
+
+// CleanInactiveRooms deletes rooms without members which have been inactive for too long, except
+// for persistent rooms, which are archived instead. Rooms which fail to be cleaned are skipped, and
+// the errors are returned together.
+func CleanInactiveRooms() error {
+	now := time.Now()
+	ttls := config.RoomTTLs
+	var errs []error
+	ids, err := findEmptyRooms(findInactiveRoomsStmt, now.Add(-time.Duration(ttls.Inactive)*time.Minute))
+	errs = append(errs, err)
+	for _, id := range ids {
+		errs = append(errs, deleteInactiveRoom(id))
+	}
+	ids, err = findEmptyRooms(findArchivableRoomsStmt, now.Add(-time.Duration(ttls.Persistent)*time.Minute))
+	errs = append(errs, err)
+	for _, id := range ids {
+		if _, err := archiveRoomStmt.Exec(id); err != nil {
+			errs = append(errs, err)
+		} else {
+			forgetRoom(id)
 		}
-		CleanInactiveRooms()
 	}
+	if ttls.Archived > 0 {
+		ids, err = findEmptyRooms(findExpiredArchivedRoomsStmt, now.Add(-time.Duration(ttls.Archived)*time.Minute))
+		errs = append(errs, err)
+		for _, id := range ids {
+			errs = append(errs, deleteInactiveRoom(id))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func CleanInactiveRooms() {
-	rows, err := findInactiveRoomsStmt.Query()
+// findEmptyRooms returns the rooms found by a statement, given a cutoff time, which have no members.
+func findEmptyRooms(stmt *sql.Stmt, before time.Time) ([]string, error) {
+	rows, err := stmt.Query(before)
 	if err != nil {
-		log.Println("Failed to find inactive rooms!", err)
-		return
+		return nil, err
 	}
 	defer rows.Close()
+	var ids []string
 	for rows.Next() {
 		var id string
 		if err = rows.Scan(&id); err != nil {
-			log.Println("Failed to scan inactive room!", err)
-			continue
+			return ids, err
 		}
-
 		if members, ok := roomMembers.Load(id); !ok || members.Size() == 0 {
-			result, err := deleteRoomStmt.Exec(id)
-			if err != nil {
-				log.Println("Failed to delete inactive room!", err)
-			} else if rows, err := result.RowsAffected(); err != nil || rows != 1 {
-				log.Println("Failed to delete inactive room!", err)
-			} else {
-				roomMembers.Delete(id)
-			}
+			ids = append(ids, id)
 		}
 	}
-	if rows.Err() != nil {
-		log.Println("Failed to scan inactive room!", err)
+	return ids, rows.Err()
+}
+
+func deleteInactiveRoom(id string) error {
+	result, err := deleteRoomStmt.Exec(id)
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 1 {
+		roomMembers.Delete(id)
+		forgetRoom(id)
 	}
+	return nil
+}
+
+// forgetRoom clears the cached state of a room which is no longer active.
+func forgetRoom(id string) {
+	roomNicknames.Delete(id)
+	roomSlowModes.Delete(id)
+	roomLastMessages.Delete(id)
+	roomFilters.Delete(id)
+	roomMutes.Delete(id)
+	subtitleExtractionJobs.Delete(id)
 }
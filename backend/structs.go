@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -34,17 +35,33 @@ type Avatar struct {
 	Hash      string    `json:"hash"`
 	Data      []byte    `json:"data"`
 	CreatedAt time.Time `json:"updatedAt"`
+	Animated  bool      `json:"animated"`
 }
 
 type Room struct {
-	ID         string    `json:"id"`
-	CreatedAt  time.Time `json:"createdAt"`
-	ModifiedAt time.Time `json:"modifiedAt"`
-	Type       string    `json:"type"`
-	Target     string    `json:"target"`
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ModifiedAt time.Time  `json:"modifiedAt"`
+	Type       string     `json:"type"`
+	Target     string     `json:"target"`
+	OwnerID    *uuid.UUID `json:"ownerId"`
+	SlowMode   int        `json:"slowMode"` // Seconds
 
-	Chat      []ChatMessage `json:"chat,omitempty"`      // Omitted in WebSocket room info
-	Subtitles []string      `json:"subtitles,omitempty"` // Omitted in WebSocket room info
+	SubtitleOffset float64 `json:"subtitleOffset"` // Seconds
+
+	Persistent bool       `json:"persistent"`
+	ArchivedAt *time.Time `json:"archivedAt"` // Archived rooms are reactivated when joined
+
+	Visibility  string  `json:"visibility"`
+	Password    *string `json:"-"` // Hashed
+	HasPassword bool    `json:"hasPassword"`
+
+	Title       string `json:"title"`
+	Description string `json:"description"`
+
+	Chat             []ChatMessage      `json:"chat,omitempty"`             // Omitted in WebSocket room info
+	Subtitles        []string           `json:"subtitles,omitempty"`        // Omitted in WebSocket room info
+	SubtitleMetadata []SubtitleMetadata `json:"subtitleMetadata,omitempty"` // Omitted in WebSocket room info
 
 	Paused     bool      `json:"paused"`
 	Speed      float64   `json:"speed"`
@@ -52,11 +69,80 @@ type Room struct {
 	LastAction time.Time `json:"lastAction"`
 }
 
+// RoomListing is the public summary of a room shown in room lists.
+type RoomListing struct {
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Type        string     `json:"type"`
+	Visibility  string     `json:"visibility"`
+	MemberCount int        `json:"memberCount"` // Users currently connected
+	Paused      bool       `json:"paused"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ModifiedAt  time.Time  `json:"modifiedAt"`
+	JoinedAt    *time.Time `json:"joinedAt,omitempty"` // Only in a user's recent rooms
+}
+
+const (
+	RoomVisibilityPublic   = "public"   // Listed in the room directory
+	RoomVisibilityUnlisted = "unlisted" // Anyone with the room ID can join
+	RoomVisibilityPrivate  = "private"  // Only members and those with an invite can join
+)
+
+// IsModerator returns whether the given user can moderate this room. Currently, only the room's
+// owner can do so, and rooms created before ownership was tracked have no moderators.
+func (r *Room) IsModerator(userID uuid.UUID) bool {
+	return r.OwnerID != nil && *r.OwnerID == userID
+}
+
+type SubtitleMetadata struct {
+	Name       string     `json:"name"`
+	Language   string     `json:"language"` // BCP 47 language tag, may be empty
+	Label      string     `json:"label"`
+	UploaderID *uuid.UUID `json:"uploaderId"`
+	UploadedAt time.Time  `json:"uploadedAt"`
+	CueCount   int        `json:"cueCount"`
+	Forced     bool       `json:"forced"`
+	SDH        bool       `json:"sdh"`
+	Offset     float64    `json:"offset"` // Seconds, added to the room's subtitle offset
+	Version    int        `json:"version"`
+}
+
+// Only the most recent versions of each subtitle are kept
+const maxSubtitleVersions = 20
+
+type SubtitleVersion struct {
+	Version    int        `json:"version"`
+	Format     string     `json:"format"` // Format of the original upload
+	UploaderID *uuid.UUID `json:"uploaderId"`
+	UploadedAt time.Time  `json:"uploadedAt"`
+	CueCount   int        `json:"cueCount"`
+}
+
 type ChatMessage struct {
-	ID        int       `json:"id"`
-	UserID    uuid.UUID `json:"userId"`
-	Message   string    `json:"message"`
-	Timestamp time.Time `json:"timestamp"`
+	ID        int        `json:"id"`
+	UserID    uuid.UUID  `json:"userId"`              // uuid.Nil for system messages
+	SubjectID *uuid.UUID `json:"subjectId,omitempty"` // The user a system message is about, named before it
+	Message   string     `json:"message"`
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// System messages are stored prefixed with the ID of their subject, e.g. "<id> joined", which is
+// moved to SubjectID when they are loaded, so clients can show the user's name instead.
+func systemMessageText(subjectId uuid.UUID, msg string) string {
+	return subjectId.String() + " " + msg
+}
+
+func (c *ChatMessage) splitSubject() {
+	if c.UserID != uuid.Nil {
+		return
+	}
+	if id, rest, ok := strings.Cut(c.Message, " "); ok {
+		if subjectId, err := uuid.Parse(id); err == nil {
+			c.SubjectID = &subjectId
+			c.Message = rest
+		}
+	}
 }
 
 func (c *ChatMessage) Scan(src interface{}) error {
@@ -74,6 +160,33 @@ func (c ChatMessage) Value() (driver.Value, error) {
 	return json.Marshal(c)
 }
 
+type RoomInvite struct {
+	ID        string     `json:"id"`
+	Token     string     `json:"token"` // Used in invite links, the same as the ID
+	CreatorID *uuid.UUID `json:"creatorId"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	MaxUses   int        `json:"maxUses"` // 0 for unlimited
+	Uses      int        `json:"uses"`
+}
+
+type ModerationLog struct {
+	ID          int        `json:"id"`
+	ModeratorID *uuid.UUID `json:"moderatorId"` // nil for automatic actions e.g. chat filters
+	TargetID    *uuid.UUID `json:"targetId"`
+	Action      string     `json:"action"`
+	Details     string     `json:"details"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+type RoomBan struct {
+	UserID      uuid.UUID  `json:"userId"`
+	ModeratorID *uuid.UUID `json:"moderatorId"`
+	Reason      string     `json:"reason"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt"` // nil for permanent bans
+}
+
 type PasswordResetToken struct {
 	ID        uuid.UUID `json:"id"`
 	UserID    uuid.UUID `json:"userId"`
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	SubtitleFormatWebVTT = "vtt"
+	SubtitleFormatSRT    = "srt"
+	SubtitleFormatASS    = "ass" // Also covers SSA
+	SubtitleFormatTTML   = "ttml"
+)
+
+var SubtitleContentTypes = map[string]string{
+	SubtitleFormatWebVTT: "text/vtt; charset=utf-8",
+	SubtitleFormatSRT:    "application/x-subrip; charset=utf-8",
+	SubtitleFormatASS:    "text/x-ssa; charset=utf-8",
+	SubtitleFormatTTML:   "application/ttml+xml; charset=utf-8",
+}
+
+type SubtitleCue struct {
+	ID       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string // WebVTT cue settings, if any
+	Text     string // WebVTT cue text
+}
+
+type Subtitle struct {
+	Format string
+	Cues   []SubtitleCue
+}
+
+type SubtitleError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+const maxSubtitleErrors = 20
+
+// DecodeSubtitleText converts subtitle file data to UTF-8 text, rejecting binary data.
+func DecodeSubtitleText(data []byte) (string, error) {
+	var text string
+	if bytes.HasPrefix(data, []byte{0xFF, 0xFE}) || bytes.HasPrefix(data, []byte{0xFE, 0xFF}) {
+		if len(data)%2 != 0 {
+			return "", errors.New("invalid UTF-16 data")
+		}
+		units := make([]uint16, len(data)/2-1)
+		for i := range units {
+			if data[0] == 0xFF { // Little endian
+				units[i] = uint16(data[2*i+2]) | uint16(data[2*i+3])<<8
+			} else {
+				units[i] = uint16(data[2*i+2])<<8 | uint16(data[2*i+3])
+			}
+		}
+		text = string(utf16.Decode(units))
+	} else if !utf8.Valid(data) {
+		return "", errors.New("invalid UTF-8 data")
+	} else {
+		text = strings.TrimPrefix(string(data), "\uFEFF")
+	}
+	if strings.ContainsRune(text, 0) {
+		return "", errors.New("subtitle data contains null characters")
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n"), nil
+}
+
+// DetectSubtitleFormat guesses the format of decoded subtitle text.
+func DetectSubtitleFormat(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "WEBVTT") {
+		return SubtitleFormatWebVTT
+	} else if strings.HasPrefix(trimmed, "<") {
+		return SubtitleFormatTTML
+	} else if strings.Contains(text, "[Script Info]") || strings.Contains(text, "[Events]") {
+		return SubtitleFormatASS
+	}
+	return SubtitleFormatSRT
+}
+
+// ParseSubtitle parses decoded subtitle text in any supported format, returning line-level errors
+// if the subtitles are malformed.
+func ParseSubtitle(text string) (*Subtitle, []SubtitleError) {
+	var subtitle *Subtitle
+	var errs []SubtitleError
+	switch format := DetectSubtitleFormat(text); format {
+	case SubtitleFormatWebVTT:
+		subtitle, errs = parseWebVTT(text)
+	case SubtitleFormatTTML:
+		subtitle, errs = parseTTML(text)
+	case SubtitleFormatASS:
+		subtitle, errs = parseASS(text)
+	default:
+		subtitle, errs = parseSRT(text)
+	}
+	if len(errs) == 0 && len(subtitle.Cues) == 0 {
+		errs = append(errs, SubtitleError{Line: 1, Message: "No subtitle cues found!"})
+	}
+	if len(errs) > 0 {
+		return nil, errs[:min(len(errs), maxSubtitleErrors)]
+	}
+	slices.SortStableFunc(subtitle.Cues, func(a, b SubtitleCue) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return subtitle, nil
+}
+
+// WebVTT renders the subtitle in WebVTT format.
+func (s *Subtitle) WebVTT() string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range s.Cues {
+		if cue.ID != "" {
+			b.WriteString(cue.ID + "\n")
+		}
+		b.WriteString(formatVTTTimestamp(cue.Start) + " --> " + formatVTTTimestamp(cue.End))
+		if cue.Settings != "" {
+			b.WriteString(" " + cue.Settings)
+		}
+		b.WriteString("\n" + cue.Text + "\n\n")
+	}
+	return b.String()
+}
+
+// Retime maps every cue time t to to + (t - from) * scale, which shifts the subtitle when scale is
+// 1 and stretches it otherwise (e.g. to fix a framerate mismatch). Cues which would end before
+// the start of the media are dropped, and those starting before it are clamped to the start.
+func (s *Subtitle) Retime(from, to time.Duration, scale float64) {
+	retime := func(t time.Duration) time.Duration {
+		return max(0, to+time.Duration(float64(t-from)*scale))
+	}
+	cues := s.Cues[:0]
+	for _, cue := range s.Cues {
+		cue.Start, cue.End = retime(cue.Start), retime(cue.End)
+		if cue.End > 0 {
+			cues = append(cues, cue)
+		}
+	}
+	s.Cues = cues
+}
+
+type SubtitleDiff struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Retimed   int `json:"retimed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// DiffSubtitles summarises the changes from one subtitle to another. Cues are matched by their
+// text in order of appearance, so a cue whose text was edited counts as removed and added.
+func DiffSubtitles(from *Subtitle, to *Subtitle) SubtitleDiff {
+	var diff SubtitleDiff
+	unmatched := make(map[string][]SubtitleCue)
+	for _, cue := range from.Cues {
+		unmatched[cue.Text] = append(unmatched[cue.Text], cue)
+	}
+	for _, cue := range to.Cues {
+		candidates := unmatched[cue.Text]
+		if len(candidates) == 0 {
+			diff.Added++
+			continue
+		}
+		if candidates[0].Start == cue.Start && candidates[0].End == cue.End {
+			diff.Unchanged++
+		} else {
+			diff.Retimed++
+		}
+		unmatched[cue.Text] = candidates[1:]
+	}
+	for _, candidates := range unmatched {
+		diff.Removed += len(candidates)
+	}
+	return diff
+}
+
+func formatVTTTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return pad2(int(ms/3600000)) + ":" + pad2(int(ms/60000%60)) + ":" + pad2(int(ms/1000%60)) +
+		"." + strconv.Itoa(int(1000 + ms%1000))[1:]
+}
+
+func pad2(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+// parseClockTime converts the parts of a [h:]mm:ss[.fraction] timestamp into a duration.
+func parseClockTime(hours, minutes, seconds, fraction string) time.Duration {
+	h, _ := strconv.Atoi(hours)
+	m, _ := strconv.Atoi(minutes)
+	s, _ := strconv.Atoi(seconds)
+	ms := 0
+	if fraction != "" {
+		ms, _ = strconv.Atoi((fraction + "00")[:3])
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(ms)*time.Millisecond
+}
+
+var vttTagRegex = regexp.MustCompile(`<(/?)([a-zA-Z]+)[^>]*>`)
+
+// toVTTText escapes cue text for WebVTT, optionally keeping bold, italic and underline tags.
+func toVTTText(text string, keepTags bool) string {
+	var b strings.Builder
+	position := 0
+	escape := func(s string) string {
+		s = strings.ReplaceAll(s, "&", "&amp;")
+		s = strings.ReplaceAll(s, "<", "&lt;")
+		return strings.ReplaceAll(s, ">", "&gt;")
+	}
+	if keepTags {
+		for _, match := range vttTagRegex.FindAllStringSubmatchIndex(text, -1) {
+			b.WriteString(escape(text[position:match[0]]))
+			tag := strings.ToLower(text[match[4]:match[5]])
+			if tag == "b" || tag == "i" || tag == "u" {
+				b.WriteString("<" + text[match[2]:match[3]] + tag + ">")
+			} // Other tags e.g. <font> are dropped
+			position = match[1]
+		}
+	}
+	b.WriteString(escape(text[position:]))
+	// Cue text cannot contain blank lines
+	lines := strings.Split(b.String(), "\n")
+	lines = slices.DeleteFunc(lines, func(line string) bool { return strings.TrimSpace(line) == "" })
+	return strings.Join(lines, "\n")
+}
+
+var srtTimingRegex = regexp.MustCompile(
+	`^\s*(\d+):(\d{1,2}):(\d{1,2})(?:[,.](\d{1,3}))?\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})(?:[,.](\d{1,3}))?`)
+
+func parseSRT(text string) (*Subtitle, []SubtitleError) {
+	subtitle := &Subtitle{Format: SubtitleFormatSRT}
+	var errs []SubtitleError
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines) && len(errs) < maxSubtitleErrors; {
+		if strings.TrimSpace(lines[i]) == "" {
+			i++
+			continue
+		}
+		// Read the block of lines until the next blank line
+		start := i
+		for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+			i++
+		}
+		block := lines[start:i]
+		timingLine := 0
+		if _, err := strconv.Atoi(strings.TrimSpace(block[0])); err == nil && len(block) > 1 {
+			timingLine = 1 // Skip the cue number
+		}
+		match := srtTimingRegex.FindStringSubmatch(block[timingLine])
+		if match == nil {
+			errs = append(errs, SubtitleError{Line: start + timingLine + 1,
+				Message: "Expected a timestamp line like 00:00:01,000 --> 00:00:02,000"})
+			continue
+		}
+		cue := SubtitleCue{
+			Start: parseClockTime(match[1], match[2], match[3], match[4]),
+			End:   parseClockTime(match[5], match[6], match[7], match[8]),
+			Text:  toVTTText(strings.Join(block[timingLine+1:], "\n"), true),
+		}
+		if cue.End < cue.Start {
+			errs = append(errs, SubtitleError{Line: start + timingLine + 1,
+				Message: "Cue ends before it starts"})
+			continue
+		}
+		subtitle.Cues = append(subtitle.Cues, cue)
+	}
+	return subtitle, errs
+}
+
+var vttTimestampRegex = regexp.MustCompile(`^(?:(\d+):)?(\d{2}):(\d{2})\.(\d{3})$`)
+
+func parseVTTTimestamp(timestamp string) (time.Duration, bool) {
+	match := vttTimestampRegex.FindStringSubmatch(timestamp)
+	if match == nil {
+		return 0, false
+	}
+	return parseClockTime(match[1], match[2], match[3], match[4]), true
+}
+
+func parseWebVTT(text string) (*Subtitle, []SubtitleError) {
+	subtitle := &Subtitle{Format: SubtitleFormatWebVTT}
+	var errs []SubtitleError
+	lines := strings.Split(text, "\n")
+	i := 0
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	if header := strings.TrimSpace(lines[i]); header != "WEBVTT" &&
+		!strings.HasPrefix(header, "WEBVTT ") && !strings.HasPrefix(header, "WEBVTT\t") {
+		return nil, []SubtitleError{{Line: i + 1, Message: "Expected WEBVTT header"}}
+	}
+	for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+		i++ // Skip the header block
+	}
+	for i < len(lines) && len(errs) < maxSubtitleErrors {
+		if strings.TrimSpace(lines[i]) == "" {
+			i++
+			continue
+		}
+		start := i
+		for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+			i++
+		}
+		block := lines[start:i]
+		if strings.HasPrefix(block[0], "NOTE") || strings.HasPrefix(block[0], "STYLE") ||
+			strings.HasPrefix(block[0], "REGION") {
+			continue
+		}
+		cue := SubtitleCue{}
+		timingLine := 0
+		if !strings.Contains(block[0], "-->") {
+			cue.ID = block[0]
+			timingLine = 1
+		}
+		if timingLine >= len(block) {
+			errs = append(errs, SubtitleError{Line: start + 1, Message: "Expected a timestamp line after cue identifier"})
+			continue
+		}
+		fields := strings.Fields(block[timingLine])
+		var startOk, endOk bool
+		if len(fields) >= 3 && fields[1] == "-->" {
+			cue.Start, startOk = parseVTTTimestamp(fields[0])
+			cue.End, endOk = parseVTTTimestamp(fields[2])
+			cue.Settings = strings.Join(fields[3:], " ")
+		}
+		if !startOk || !endOk {
+			errs = append(errs, SubtitleError{Line: start + timingLine + 1,
+				Message: "Expected a timestamp line like 00:00:01.000 --> 00:00:02.000"})
+			continue
+		} else if cue.End < cue.Start {
+			errs = append(errs, SubtitleError{Line: start + timingLine + 1, Message: "Cue ends before it starts"})
+			continue
+		}
+		cue.Text = strings.Join(block[timingLine+1:], "\n")
+		subtitle.Cues = append(subtitle.Cues, cue)
+	}
+	return subtitle, errs
+}
+
+var assTimeRegex = regexp.MustCompile(`^(\d+):(\d{1,2}):(\d{1,2})(?:\.(\d+))?$`)
+var assOverrideRegex = regexp.MustCompile(`\{[^}]*\}`)
+
+func parseASS(text string) (*Subtitle, []SubtitleError) {
+	subtitle := &Subtitle{Format: SubtitleFormatASS}
+	var errs []SubtitleError
+	var format []string
+	section := ""
+	foundEvents := false
+	for i, line := range strings.Split(text, "\n") {
+		if len(errs) >= maxSubtitleErrors {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line)
+			foundEvents = foundEvents || section == "[events]"
+			continue
+		} else if section != "[events]" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		} else if key == "Format" {
+			format = strings.Split(value, ",")
+			for j := range format {
+				format[j] = strings.ToLower(strings.TrimSpace(format[j]))
+			}
+			continue
+		} else if key != "Dialogue" {
+			continue // Comments and other event types
+		} else if format == nil {
+			errs = append(errs, SubtitleError{Line: i + 1, Message: "Dialogue found before Format line"})
+			continue
+		}
+		fields := strings.SplitN(value, ",", len(format))
+		startIdx, endIdx, textIdx :=
+			slices.Index(format, "start"), slices.Index(format, "end"), slices.Index(format, "text")
+		if len(fields) != len(format) || startIdx == -1 || endIdx == -1 || textIdx == -1 {
+			errs = append(errs, SubtitleError{Line: i + 1, Message: "Dialogue does not match Format line"})
+			continue
+		}
+		startMatch := assTimeRegex.FindStringSubmatch(strings.TrimSpace(fields[startIdx]))
+		endMatch := assTimeRegex.FindStringSubmatch(strings.TrimSpace(fields[endIdx]))
+		if startMatch == nil || endMatch == nil {
+			errs = append(errs, SubtitleError{Line: i + 1, Message: "Invalid start or end time"})
+			continue
+		}
+		cue := SubtitleCue{
+			Start: parseClockTime(startMatch[1], startMatch[2], startMatch[3], startMatch[4]),
+			End:   parseClockTime(endMatch[1], endMatch[2], endMatch[3], endMatch[4]),
+		}
+		if cue.End < cue.Start {
+			errs = append(errs, SubtitleError{Line: i + 1, Message: "Cue ends before it starts"})
+			continue
+		}
+		cueText := assOverrideRegex.ReplaceAllString(fields[textIdx], "")
+		cueText = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(cueText)
+		if cue.Text = toVTTText(cueText, false); cue.Text != "" {
+			subtitle.Cues = append(subtitle.Cues, cue)
+		}
+	}
+	if len(errs) == 0 && !foundEvents {
+		errs = append(errs, SubtitleError{Line: 1, Message: "No [Events] section found"})
+	}
+	return subtitle, errs
+}
+
+var ttmlClockRegex = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2})(?:\.(\d+)|:(\d+(?:\.\d+)?))?$`)
+var ttmlWhitespaceRegex = regexp.MustCompile(`\s+`)
+var ttmlOffsetRegex = regexp.MustCompile(`^(\d+(?:\.\d+)?)(h|m|s|ms|f|t)$`)
+
+func parseTTMLTime(expr string, frameRate float64, tickRate float64) (time.Duration, bool) {
+	expr = strings.TrimSpace(expr)
+	if match := ttmlClockRegex.FindStringSubmatch(expr); match != nil {
+		d := parseClockTime(match[1], match[2], match[3], match[4])
+		if match[5] != "" {
+			frames, _ := strconv.ParseFloat(match[5], 64)
+			d += time.Duration(frames / frameRate * float64(time.Second))
+		}
+		return d, true
+	} else if match := ttmlOffsetRegex.FindStringSubmatch(expr); match != nil {
+		value, _ := strconv.ParseFloat(match[1], 64)
+		unit := map[string]float64{
+			"h": float64(time.Hour), "m": float64(time.Minute), "s": float64(time.Second),
+			"ms": float64(time.Millisecond), "f": float64(time.Second) / frameRate,
+			"t": float64(time.Second) / tickRate,
+		}[match[2]]
+		return time.Duration(value * unit), true
+	}
+	return 0, false
+}
+
+func parseTTML(text string) (*Subtitle, []SubtitleError) {
+	subtitle := &Subtitle{Format: SubtitleFormatTTML}
+	var errs []SubtitleError
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	frameRate, tickRate := 30.0, 1.0
+	var cue *SubtitleCue
+	var cueText strings.Builder
+	foundRoot := false
+	for len(errs) < maxSubtitleErrors {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			line, _ := decoder.InputPos()
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line = syntaxErr.Line
+			}
+			errs = append(errs, SubtitleError{Line: line, Message: "Invalid XML: " + err.Error()})
+			break
+		}
+		line, _ := decoder.InputPos()
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "tt":
+				foundRoot = true
+				for _, attr := range token.Attr {
+					if value, err := strconv.ParseFloat(attr.Value, 64); err == nil && value > 0 {
+						if attr.Name.Local == "frameRate" {
+							frameRate = value
+						} else if attr.Name.Local == "tickRate" {
+							tickRate = value
+						}
+					}
+				}
+			case "p":
+				cue = &SubtitleCue{}
+				cueText.Reset()
+				var begin, end, dur string
+				for _, attr := range token.Attr {
+					switch attr.Name.Local {
+					case "begin":
+						begin = attr.Value
+					case "end":
+						end = attr.Value
+					case "dur":
+						dur = attr.Value
+					}
+				}
+				var ok bool
+				if cue.Start, ok = parseTTMLTime(begin, frameRate, tickRate); !ok {
+					errs = append(errs, SubtitleError{Line: line, Message: "Missing or invalid begin time"})
+					cue = nil
+				} else if end != "" {
+					if cue.End, ok = parseTTMLTime(end, frameRate, tickRate); !ok {
+						errs = append(errs, SubtitleError{Line: line, Message: "Invalid end time"})
+						cue = nil
+					}
+				} else if duration, ok := parseTTMLTime(dur, frameRate, tickRate); ok {
+					cue.End = cue.Start + duration
+				} else {
+					errs = append(errs, SubtitleError{Line: line, Message: "Missing or invalid end time"})
+					cue = nil
+				}
+				if cue != nil && cue.End < cue.Start {
+					errs = append(errs, SubtitleError{Line: line, Message: "Cue ends before it starts"})
+					cue = nil
+				}
+			case "br":
+				cueText.WriteString("\n")
+			}
+		case xml.CharData:
+			if cue != nil { // Whitespace is collapsed, except for explicit <br> line breaks
+				cueText.WriteString(ttmlWhitespaceRegex.ReplaceAllString(string(token), " "))
+			}
+		case xml.EndElement:
+			if token.Name.Local == "p" && cue != nil {
+				lines := strings.Split(cueText.String(), "\n")
+				for i := range lines {
+					lines[i] = strings.Join(strings.Fields(lines[i]), " ")
+				}
+				if cue.Text = toVTTText(strings.Join(lines, "\n"), false); cue.Text != "" {
+					subtitle.Cues = append(subtitle.Cues, *cue)
+				}
+				cue = nil
+			}
+		}
+	}
+	if len(errs) == 0 && !foundRoot {
+		errs = append(errs, SubtitleError{Line: 1, Message: "Expected a TTML <tt> root element"})
+	}
+	return subtitle, errs
+}
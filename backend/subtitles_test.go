@@ -0,0 +1,246 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestDecodeSubtitleText(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"utf-8", []byte("a\r\nb\rc"), "a\nb\nc", false},
+		{"utf-8 bom", []byte("\uFEFFa"), "a", false},
+		{"utf-16le", []byte{0xFF, 0xFE, 'h', 0, 'i', 0}, "hi", false},
+		{"utf-16be", []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, "hi", false},
+		{"odd utf-16", []byte{0xFF, 0xFE, 'h'}, "", true},
+		{"invalid utf-8", []byte{0xC3, 0x28}, "", true},
+		{"null characters", []byte("a\x00b"), "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeSubtitleText(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("DecodeSubtitleText() error = %v, wantErr %v", err, test.wantErr)
+			} else if got != test.want {
+				t.Errorf("DecodeSubtitleText() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSubtitle(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		format string
+		cues   []SubtitleCue
+	}{
+		{
+			name: "srt",
+			text: "1\n00:00:01,000 --> 00:00:02,500\n<b>Hello</b> <font color=\"red\">world</font>\n\n" +
+				"2\n00:00:03,000 --> 00:00:04,000\na < b\n",
+			format: SubtitleFormatSRT,
+			cues: []SubtitleCue{
+				{Start: ms(1000), End: ms(2500), Text: "<b>Hello</b> world"},
+				{Start: ms(3000), End: ms(4000), Text: "a &lt; b"},
+			},
+		},
+		{
+			name:   "srt without cue numbers, sorted by start",
+			text:   "00:00:05.5 --> 00:00:06\nSecond\n\n00:00:01,000 --> 00:00:02,000\nFirst\n",
+			format: SubtitleFormatSRT,
+			cues: []SubtitleCue{
+				{Start: ms(1000), End: ms(2000), Text: "First"},
+				{Start: ms(5500), End: ms(6000), Text: "Second"},
+			},
+		},
+		{
+			name: "webvtt",
+			text: "WEBVTT - Title\n\nNOTE a comment\n\nintro\n00:01.000 --> 00:02.000 align:start\nHi\nthere\n\n" +
+				"01:00:00.000 --> 01:00:01.000\nLater\n",
+			format: SubtitleFormatWebVTT,
+			cues: []SubtitleCue{
+				{ID: "intro", Start: ms(1000), End: ms(2000), Settings: "align:start", Text: "Hi\nthere"},
+				{Start: time.Hour, End: time.Hour + ms(1000), Text: "Later"},
+			},
+		},
+		{
+			name: "ass",
+			text: "[Script Info]\nTitle: Test\n\n[Events]\nFormat: Layer, Start, End, Style, Text\n" +
+				"Comment: 0,0:00:00.00,0:00:01.00,Default,Ignored\n" +
+				"Dialogue: 0,0:00:01.50,0:00:03.00,Default,{\\i1}Hello,\\Nworld\n" +
+				"Dialogue: 0,0:00:04.00,0:00:05.00,Default,{\\pos(1,2)}\n",
+			format: SubtitleFormatASS,
+			cues:   []SubtitleCue{{Start: ms(1500), End: ms(3000), Text: "Hello,\nworld"}},
+		},
+		{
+			name: "ttml",
+			text: `<tt xmlns="http://www.w3.org/ns/ttml" xmlns:ttp="http://www.w3.org/ns/ttml#parameter" ` +
+				`ttp:frameRate="25"><body><div>` +
+				`<p begin="00:00:01.000" end="00:00:02.000">Hello <br/>  world</p>` +
+				`<p begin="3s" dur="500ms">A &amp; B</p>` +
+				`<p begin="00:00:04:05" end="00:00:05:00">Frames</p>` +
+				`</div></body></tt>`,
+			format: SubtitleFormatTTML,
+			cues: []SubtitleCue{
+				{Start: ms(1000), End: ms(2000), Text: "Hello\nworld"},
+				{Start: ms(3000), End: ms(3500), Text: "A &amp; B"},
+				{Start: ms(4200), End: ms(5000), Text: "Frames"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subtitle, errs := ParseSubtitle(test.text)
+			if len(errs) > 0 {
+				t.Fatalf("ParseSubtitle() errors = %v", errs)
+			} else if subtitle.Format != test.format {
+				t.Errorf("ParseSubtitle() format = %q, want %q", subtitle.Format, test.format)
+			}
+			if !slices.Equal(subtitle.Cues, test.cues) {
+				t.Errorf("ParseSubtitle() cues = %+v, want %+v", subtitle.Cues, test.cues)
+			}
+		})
+	}
+}
+
+func TestParseSubtitleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		line int
+	}{
+		{"empty", "", 1},
+		{"srt missing timing", "1\nHello\n", 2},
+		{"srt ends before start", "1\n00:00:02,000 --> 00:00:01,000\nHello\n", 2},
+		{"webvtt bad timing", "WEBVTT\n\n00:01 --> 00:02\nHello\n", 3},
+		{"webvtt missing timing", "WEBVTT\n\nid-only\n", 3},
+		{"ass without events", "[Script Info]\nTitle: Test\n", 1},
+		{"ass dialogue before format", "[Events]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,Hi\n", 2},
+		{"ass bad time", "[Events]\nFormat: Start, End, Text\nDialogue: 1s,0:00:02.00,Hi\n", 3},
+		{"ttml invalid xml", "<tt>\n<p begin=\"1s\" end=\"2s\">Hi</tt>", 2},
+		{"ttml missing end", "<tt><p begin=\"1s\">Hi</p></tt>", 1},
+		{"ttml without root", "<html></html>", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subtitle, errs := ParseSubtitle(test.text)
+			if len(errs) == 0 {
+				t.Fatalf("ParseSubtitle() = %+v, want errors", subtitle)
+			} else if errs[0].Line != test.line {
+				t.Errorf("ParseSubtitle() error %q on line %d, want line %d",
+					errs[0].Message, errs[0].Line, test.line)
+			}
+		})
+	}
+}
+
+func TestParseSubtitleErrorLimit(t *testing.T) {
+	text := ""
+	for range maxSubtitleErrors * 2 {
+		text += "not a cue\n\n"
+	}
+	if _, errs := ParseSubtitle(text); len(errs) != maxSubtitleErrors {
+		t.Errorf("ParseSubtitle() returned %d errors, want %d", len(errs), maxSubtitleErrors)
+	}
+}
+
+func TestSubtitleWebVTT(t *testing.T) {
+	subtitle := &Subtitle{Cues: []SubtitleCue{
+		{ID: "1", Start: ms(1500), End: time.Hour + ms(61001), Settings: "line:0", Text: "Hi"},
+		{Start: 0, End: ms(999), Text: "Bye"},
+	}}
+	want := "WEBVTT\n\n1\n00:00:01.500 --> 01:01:01.001 line:0\nHi\n\n00:00:00.000 --> 00:00:00.999\nBye\n\n"
+	if got := subtitle.WebVTT(); got != want {
+		t.Errorf("WebVTT() = %q, want %q", got, want)
+	}
+	sorted := []SubtitleCue{subtitle.Cues[1], subtitle.Cues[0]}
+	if parsed, errs := ParseSubtitle(want); len(errs) > 0 || !slices.Equal(parsed.Cues, sorted) {
+		t.Errorf("ParseSubtitle(WebVTT()) = %+v, %v, want %+v", parsed, errs, sorted)
+	}
+}
+
+func TestSubtitleRetime(t *testing.T) {
+	cues := func() []SubtitleCue {
+		return []SubtitleCue{
+			{Start: ms(1000), End: ms(2000), Text: "a"},
+			{Start: ms(3000), End: ms(5000), Text: "b"},
+		}
+	}
+	tests := []struct {
+		name     string
+		from, to time.Duration
+		scale    float64
+		want     []SubtitleCue
+	}{
+		{"shift forwards", 0, ms(1500), 1, []SubtitleCue{
+			{Start: ms(2500), End: ms(3500), Text: "a"},
+			{Start: ms(4500), End: ms(6500), Text: "b"},
+		}},
+		{"shift backwards clamps and drops", 0, ms(-2000), 1, []SubtitleCue{
+			{Start: ms(1000), End: ms(3000), Text: "b"},
+		}},
+		{"shift backwards to the exact end drops", 0, ms(-5000), 1, []SubtitleCue{}},
+		{"stretch around a sync point", ms(1000), ms(1000), 2, []SubtitleCue{
+			{Start: ms(1000), End: ms(3000), Text: "a"},
+			{Start: ms(5000), End: ms(9000), Text: "b"},
+		}},
+		{"shrink and shift", ms(3000), ms(6000), 0.5, []SubtitleCue{
+			{Start: ms(5000), End: ms(5500), Text: "a"},
+			{Start: ms(6000), End: ms(7000), Text: "b"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subtitle := &Subtitle{Cues: cues()}
+			subtitle.Retime(test.from, test.to, test.scale)
+			if !slices.Equal(subtitle.Cues, test.want) {
+				t.Errorf("Retime() cues = %+v, want %+v", subtitle.Cues, test.want)
+			}
+		})
+	}
+}
+
+func TestDiffSubtitles(t *testing.T) {
+	from := &Subtitle{Cues: []SubtitleCue{
+		{Start: ms(1000), End: ms(2000), Text: "same"},
+		{Start: ms(3000), End: ms(4000), Text: "moved"},
+		{Start: ms(5000), End: ms(6000), Text: "repeated"},
+		{Start: ms(7000), End: ms(8000), Text: "repeated"},
+		{Start: ms(9000), End: ms(10000), Text: "edited"},
+	}}
+	tests := []struct {
+		name string
+		to   []SubtitleCue
+		want SubtitleDiff
+	}{
+		{"identical", from.Cues, SubtitleDiff{Unchanged: 5}},
+		{"empty", []SubtitleCue{}, SubtitleDiff{Removed: 5}},
+		{"changes", []SubtitleCue{
+			{Start: ms(1000), End: ms(2000), Text: "same"},
+			{Start: ms(3500), End: ms(4500), Text: "moved"},
+			{Start: ms(5000), End: ms(6000), Text: "repeated"},
+			{Start: ms(9000), End: ms(10000), Text: "edited!"},
+			{Start: ms(11000), End: ms(12000), Text: "new"},
+		}, SubtitleDiff{Added: 2, Removed: 2, Retimed: 1, Unchanged: 2}},
+		{"repeated cues match in order", []SubtitleCue{
+			{Start: ms(7000), End: ms(8000), Text: "repeated"},
+		}, SubtitleDiff{Removed: 4, Retimed: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DiffSubtitles(from, &Subtitle{Cues: test.to}); got != test.want {
+				t.Errorf("DiffSubtitles() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ export enum RoomType {
 export interface ChatMessage {
   id: number
   userId: string
+  subjectId?: string // The user a system message is about
   message: string
   timestamp: string
 }
@@ -133,6 +134,7 @@ export interface IncomingRoomInfoMessage extends GenericMessage {
 export interface IncomingSubtitleMessage extends GenericMessage {
   type: MessageType.Subtitle
   data: string[]
+  removed?: string[]
 }
 
 export interface IncomingUserProfileUpdateMessage extends GenericMessage {